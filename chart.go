@@ -5,16 +5,17 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/dustin/go-humanize"
 	"github.com/mum4k/termdash"
 	"github.com/mum4k/termdash/cell"
 	"github.com/mum4k/termdash/container"
 	"github.com/mum4k/termdash/container/grid"
 	"github.com/mum4k/termdash/linestyle"
-	"github.com/mum4k/termdash/terminal/tcell"
 	"github.com/mum4k/termdash/terminal/terminalapi"
 	"github.com/mum4k/termdash/widgets/linechart"
 	"github.com/mum4k/termdash/widgets/text"
+	"github.com/surki/network-microburst/pkg/microburst"
 )
 
 // How many seconds of data to show in the graph (post which old data will
@@ -39,14 +40,32 @@ type chart struct {
 	showRx          bool
 	txtTimer        *text.Text
 	graphNumPoints  int64
+	annotationLock  sync.Mutex
+	lastAnnotation  microburst.Annotation
+	lastIncast      incastWindow
+	incastWindows   uint64
+	incastSources   uint64
+	classGraphs     []*classGraph
+	timerLock       sync.Mutex
+	timerHist       *hdrhistogram.Histogram
+	lastTime        time.Time
+	done            chan struct{}
+	wg              sync.WaitGroup
 }
 
-func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
-	t, err := tcell.New()
-	if err != nil {
-		return nil, err
-	}
+// classGraph is the graph of a traffic class series
+type classGraph struct {
+	name     string
+	lock     sync.Mutex
+	lc       *linechart.LineChart
+	data     *ringBuffer[float64]
+	dataTime *ringBuffer[time.Time]
+}
 
+// newChart starts the TUI graphs on the terminal, which is closed along
+// with the chart. incastSources is the incast threshold, 0 if incast is not
+// tracked.
+func newChart(t terminalapi.Terminal, showRx, showTx bool, classes []microburst.Class, burstWindow time.Duration, accounting string, incastSources uint64) (*chart, error) {
 	numPoints := int64((TUI_GRAPH_DISPLAY_SECONDS * time.Second) / burstWindow)
 	if numPoints > TUI_GRAPH_MAX_POINTS {
 		numPoints = TUI_GRAPH_MAX_POINTS
@@ -57,10 +76,26 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 		showTx:         showTx,
 		showRx:         showRx,
 		graphNumPoints: numPoints,
+		incastSources:  incastSources,
+		timerHist:      hdrhistogram.New(1, int64(10_000_000_000), 5),
+		done:           make(chan struct{}),
 	}
 
 	builder := grid.New()
 
+	// The graphs share the space above the timer accuracy
+	numGraphs := len(classes)
+	if showRx {
+		numGraphs++
+	}
+	if showTx {
+		numGraphs++
+	}
+	graphHeight := 89
+	if numGraphs > 0 {
+		graphHeight = 89 / numGraphs
+	}
+
 	if showRx {
 		lcRx, err := linechart.New(
 			linechart.AxesCellOpts(cell.FgColor(cell.ColorRed)),
@@ -76,11 +111,11 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 
 		builder.Add(
 			grid.RowHeightPerc(
-				46,
+				graphHeight,
 				grid.ColWidthPerc(99,
 					grid.Widget(lcRx,
 						container.Border(linestyle.Light),
-						container.BorderTitle(" Received "),
+						container.BorderTitle(fmt.Sprintf(" Received (%s bytes) ", accounting)),
 						container.BorderTitleAlignCenter())),
 			))
 
@@ -104,11 +139,11 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 
 		builder.Add(
 			grid.RowHeightPerc(
-				47,
+				graphHeight,
 				grid.ColWidthPerc(99,
 					grid.Widget(lcTx,
 						container.Border(linestyle.Light),
-						container.BorderTitle(" Transmitted "),
+						container.BorderTitle(fmt.Sprintf(" Transmitted (%s bytes) ", accounting)),
 						container.BorderTitleAlignCenter())),
 			))
 		c.lcTx = lcTx
@@ -116,6 +151,37 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 		c.graphDataTxTime = newRingBuffer[time.Time](TUI_GRAPH_MAX_POINTS)
 	}
 
+	for _, class := range classes {
+		lc, err := linechart.New(
+			linechart.AxesCellOpts(cell.FgColor(cell.ColorRed)),
+			linechart.YLabelCellOpts(cell.FgColor(cell.ColorGreen)),
+			linechart.XLabelCellOpts(cell.FgColor(cell.ColorGreen)),
+			linechart.YAxisFormattedValues(func(v float64) string {
+				return humanize.Bytes(uint64(v))
+			}),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		builder.Add(
+			grid.RowHeightPerc(
+				graphHeight,
+				grid.ColWidthPerc(99,
+					grid.Widget(lc,
+						container.Border(linestyle.Light),
+						container.BorderTitle(fmt.Sprintf(" %s (%s bytes) ", class.Title, accounting)),
+						container.BorderTitleAlignCenter())),
+			))
+
+		c.classGraphs = append(c.classGraphs, &classGraph{
+			name:     class.Name,
+			lc:       lc,
+			data:     newRingBuffer[float64](TUI_GRAPH_MAX_POINTS),
+			dataTime: newRingBuffer[time.Time](TUI_GRAPH_MAX_POINTS),
+		})
+	}
+
 	txtTimer, err := text.New()
 	if err != nil {
 		return nil, err
@@ -123,7 +189,7 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 
 	builder.Add(
 		grid.RowHeightPerc(
-			7,
+			10,
 			grid.ColWidthPerc(99,
 				grid.Widget(txtTimer,
 					container.Border(linestyle.Light),
@@ -136,11 +202,15 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 	if err != nil {
 		return nil, err
 	}
+	title := "PRESS Q TO QUIT"
+	if filterFile != "" {
+		title = "PRESS Q TO QUIT, R TO RELOAD FILTERS"
+	}
 	con, err := container.New(
 		c.t,
 		append(gridOpts,
 			container.Border(linestyle.Light),
-			container.BorderTitle("PRESS Q TO QUIT"))...,
+			container.BorderTitle(title))...,
 	)
 	if err != nil {
 		return nil, err
@@ -153,13 +223,19 @@ func newChart(showRx, showTx bool, burstWindow time.Duration) (*chart, error) {
 	}
 	c.controller = ctrl
 
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run()
+	}()
+
 	return c, nil
 }
 
 func (c *chart) run() {
 	for {
 		select {
-		case <-ctx.Done():
+		case <-c.done:
 			return
 		case <-time.After(REDRAW_INTERVAL):
 			if c.showRx {
@@ -181,8 +257,24 @@ func (c *chart) run() {
 				}
 			}
 
+			for _, g := range c.classGraphs {
+				y, x := g.get()
+				if err := g.lc.Series(g.name, y,
+					linechart.SeriesCellOpts(cell.FgColor(cell.ColorGreen)),
+					linechart.SeriesXLabels(timeToMapForSeriesXLabels(x)),
+				); err != nil {
+					panic(err)
+				}
+			}
+
 			c.txtTimer.Reset()
-			c.txtTimer.Write(fmt.Sprintf("Mean: %-12v StdDev: %-12v Min: %-12v Max: %-12v\n", time.Duration(timerHist.Mean()), time.Duration(int64(timerHist.StdDev())), time.Duration(timerHist.Min()), time.Duration(timerHist.Max())))
+			c.txtTimer.Write(c.timerAccuracy())
+			if w, n := c.getLastIncast(); n > 0 {
+				c.txtTimer.Write(fmt.Sprintf("Incast windows: %d, last %s with %d sources, %d flows\n", n, w.time.Format("15:04:05.000"), w.sources, w.flows))
+			}
+			if a := c.getLastAnnotation(); !a.Time.IsZero() {
+				c.txtTimer.Write(fmt.Sprintf("%s %s\n", a.Time.Format("15:04:05.000"), a.Text))
+			}
 
 			if err := c.controller.Redraw(); err != nil {
 				panic(err)
@@ -195,6 +287,69 @@ func (c *chart) kbHandler(k *terminalapi.Keyboard) {
 	if k.Key == 'q' || k.Key == 'Q' {
 		cancel()
 	}
+	if (k.Key == 'r' || k.Key == 'R') && filterFile != "" {
+		go reloadFilters()
+	}
+}
+
+func (c *chart) OnSample(s microburst.Sample) {
+	c.timerLock.Lock()
+	c.timerHist.RecordValue(int64(s.Time.Sub(c.lastTime)))
+	c.lastTime = s.Time
+	c.timerLock.Unlock()
+
+	if c.incastSources > 0 && s.Sources >= c.incastSources {
+		c.setLastIncast(incastWindowOf(s))
+	}
+
+	if c.showTx {
+		c.updateTxData(s.TxBytes, s.Time)
+	}
+	if c.showRx {
+		c.updateRxData(s.RxBytes, s.Time)
+	}
+	for i, v := range s.Classes {
+		c.updateClassData(i, v, s.Time)
+	}
+}
+
+func (c *chart) timerAccuracy() string {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+
+	return fmt.Sprintf("Mean: %-12v StdDev: %-12v Min: %-12v Max: %-12v\n", time.Duration(c.timerHist.Mean()), time.Duration(int64(c.timerHist.StdDev())), time.Duration(c.timerHist.Min()), time.Duration(c.timerHist.Max()))
+}
+
+// OnAnnotation shows the annotation below the graphs, till the next one
+func (c *chart) OnAnnotation(a microburst.Annotation) {
+	c.annotationLock.Lock()
+	defer c.annotationLock.Unlock()
+
+	c.lastAnnotation = a
+}
+
+func (c *chart) getLastAnnotation() microburst.Annotation {
+	c.annotationLock.Lock()
+	defer c.annotationLock.Unlock()
+
+	return c.lastAnnotation
+}
+
+// setLastIncast counts the incast window, the last one is shown below the
+// graphs
+func (c *chart) setLastIncast(w incastWindow) {
+	c.annotationLock.Lock()
+	defer c.annotationLock.Unlock()
+
+	c.lastIncast = w
+	c.incastWindows++
+}
+
+func (c *chart) getLastIncast() (incastWindow, uint64) {
+	c.annotationLock.Lock()
+	defer c.annotationLock.Unlock()
+
+	return c.lastIncast, c.incastWindows
 }
 
 func (c *chart) updateRxData(rx uint64, n time.Time) {
@@ -220,6 +375,24 @@ func (c *chart) updateTxData(tx uint64, n time.Time) {
 	c.graphDataTxTime.Add(n)
 }
 
+// updateClassData adds the value of the i'th class series
+func (c *chart) updateClassData(i int, v uint64, n time.Time) {
+	g := c.classGraphs[i]
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.data.Add(float64(v))
+	g.dataTime.Add(n)
+}
+
+func (g *classGraph) get() ([]float64, []time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.data.Items(), g.dataTime.Items()
+}
+
 func (c *chart) getRxData() ([]float64, []time.Time) {
 	c.rxLock.Lock()
 	defer c.rxLock.Unlock()
@@ -234,9 +407,14 @@ func (c *chart) getTxData() ([]float64, []time.Time) {
 	return c.graphDataTx.Items(), c.graphDataTxTime.Items()
 }
 
-func (c *chart) stop() {
+// Close stops the graphs and restores the terminal
+func (c *chart) Close() error {
+	close(c.done)
+	c.wg.Wait()
+
 	c.controller.Close()
 	c.t.Close()
+	return nil
 }
 
 func (c *chart) termdashErrorHandler(err error) {
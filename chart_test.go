@@ -1,9 +1,14 @@
 package main
 
 import (
+	"image"
 	"testing"
+	"time"
 
+	"github.com/mum4k/termdash/private/event/eventqueue"
+	"github.com/mum4k/termdash/private/faketerm"
 	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
 )
 
 func TestRingBuffer(t *testing.T) {
@@ -31,3 +36,31 @@ func TestRingBuffer(t *testing.T) {
 	require.Equal(t, 10, r.Len())
 	require.Equal(t, []int{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, r.Items())
 }
+
+func TestChart(t *testing.T) {
+	term, err := faketerm.New(image.Point{X: 120, Y: 40}, faketerm.WithEventQueue(eventqueue.New()))
+	require.NoError(t, err)
+
+	c, err := newChart(term, true, true, []microburst.Class{{Name: "multicast", Title: "Received multicast"}}, time.Millisecond, "l3", 32)
+	require.NoError(t, err)
+
+	runSynthetic(t, `
+classes multicast
+1000 2000 10 x3
+5000 2000 0
+@ filters changed
+`, c)
+
+	rx, rxTime := c.getRxData()
+	require.Equal(t, []float64{1000, 1000, 1000, 5000}, rx)
+	require.Len(t, rxTime, 4)
+	tx, _ := c.getTxData()
+	require.Equal(t, []float64{2000, 2000, 2000, 2000}, tx)
+	class, _ := c.classGraphs[0].get()
+	require.Equal(t, []float64{10, 10, 10, 0}, class)
+	require.Equal(t, "filters changed", c.getLastAnnotation().Text)
+	_, incasts := c.getLastIncast()
+	require.Equal(t, uint64(0), incasts)
+
+	require.NoError(t, c.Close())
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// serveControl accepts the control commands on the unix socket at path,
+// one per line. Each command is answered with "ok: ..." or "error: ...".
+func serveControl(path string, c *microburst.Collector) (net.Listener, error) {
+	// stale socket from a previous run, anything else at path is left
+	// alone
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale control socket: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on control socket: %w", err)
+	}
+	// only root can change the filters
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod control socket: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn, c)
+		}
+	}()
+
+	return l, nil
+}
+
+func handleControlConn(conn net.Conn, c *microburst.Collector) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		resp, err := c.ApplyCommand(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		} else {
+			fmt.Fprintf(conn, "ok: %s\n", resp)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeControlPath(t *testing.T) {
+	dir := t.TempDir()
+
+	// a file that isn't a socket is not removed
+	file := filepath.Join(dir, "passwd")
+	require.NoError(t, os.WriteFile(file, []byte("root"), 0o644))
+	_, err := serveControl(file, nil)
+	require.ErrorContains(t, err, "not a socket")
+	require.FileExists(t, file)
+
+	// a stale socket is replaced, and only the owner can use it
+	sock := filepath.Join(dir, "control.sock")
+	stale, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := serveControl(sock, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	fi, err := os.Stat(sock)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+}
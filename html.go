@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// htmlGraph keeps the last windows, they are plotted to the HTML file at
+// the end
+type htmlGraph struct {
+	path        string
+	accounting  string
+	trackRx     bool
+	trackTx     bool
+	classes     []microburst.Class
+	rxData      *ring.Ring
+	txData      *ring.Ring
+	classData   []*ring.Ring
+	annotations []microburst.Annotation
+}
+
+type statData struct {
+	t time.Time
+	v uint64
+}
+
+func newHtmlGraph(path string, classes []microburst.Class, burstWindow time.Duration) *htmlGraph {
+	// We will try to have at least last 10 seconds of data.
+	// But if it crosses 1 million points, we will limit it to 1
+	// million. This is to avoid the browser from hanging.
+	// TODO: Maybe we can parameterize this.
+	numSamplesPerSec := int(time.Second / burstWindow)
+	numSamples := numSamplesPerSec * 10
+	if numSamples > 1_000_000 {
+		numSamples = 1_000_000
+	}
+
+	g := &htmlGraph{
+		path:       path,
+		accounting: options.Accounting,
+		trackRx:    options.TrackRx,
+		trackTx:    options.TrackTx,
+		classes:    classes,
+		rxData:     ring.New(numSamples),
+		txData:     ring.New(numSamples),
+	}
+	for range classes {
+		g.classData = append(g.classData, ring.New(numSamples))
+	}
+	return g
+}
+
+func (g *htmlGraph) OnSample(s microburst.Sample) {
+	if g.trackRx {
+		g.rxData.Value = statData{s.Time, s.RxBytes}
+		g.rxData = g.rxData.Next()
+	}
+	if g.trackTx {
+		g.txData.Value = statData{s.Time, s.TxBytes}
+		g.txData = g.txData.Next()
+	}
+	for i, v := range s.Classes {
+		g.classData[i].Value = statData{s.Time, v}
+		g.classData[i] = g.classData[i].Next()
+	}
+}
+
+// OnAnnotation marks the annotation as a vertical line in the graphs
+func (g *htmlGraph) OnAnnotation(a microburst.Annotation) {
+	g.annotations = append(g.annotations, a)
+}
+
+// Close saves the graph
+func (g *htmlGraph) Close() error {
+	page := components.NewPage()
+	page.SetLayout(components.PageFlexLayout)
+	page.AddCharts(
+		g.getScatter("Data receive", "Receive", g.rxData),
+		g.getScatter("Data transfer", "Transfer", g.txData),
+	)
+	for i, class := range g.classes {
+		page.AddCharts(g.getScatter(class.Title, class.Name, g.classData[i]))
+	}
+	f, err := os.Create(g.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = page.Render(f)
+	if err != nil {
+		return fmt.Errorf("save graph: %w", err)
+	}
+	log.Printf("saved graph at %s\n", g.path)
+	return nil
+}
+
+func (g *htmlGraph) getScatter(title string, name string, data *ring.Ring) *charts.Scatter {
+	scatter := g.newScatter(title)
+
+	var x []string
+	var d []opts.ScatterData
+	data.Do(func(p any) {
+		if p == nil {
+			return
+		}
+		sd := p.(statData)
+		x = append(x, sd.t.Format("15:04:05.000"))
+		d = append(d, opts.ScatterData{
+			Value:        sd.v,
+			Symbol:       "roundRect",
+			SymbolSize:   5,
+			SymbolRotate: 0,
+		})
+	})
+
+	scatter.SetXAxis(x).
+		AddSeries(name, d, g.annotationMarkLines()...)
+
+	return scatter
+}
+
+// annotationMarkLines marks the annotations as vertical lines in the graph
+func (g *htmlGraph) annotationMarkLines() []charts.SeriesOpts {
+	if len(g.annotations) == 0 {
+		return nil
+	}
+
+	var items []opts.MarkLineNameXAxisItem
+	for _, a := range g.annotations {
+		items = append(items, opts.MarkLineNameXAxisItem{
+			Name:  a.Text,
+			XAxis: a.Time.Format("15:04:05.000"),
+		})
+	}
+
+	return []charts.SeriesOpts{
+		charts.WithMarkLineNameXAxisItemOpts(items...),
+		charts.WithMarkLineStyleOpts(opts.MarkLineStyle{
+			Label: &opts.Label{Show: true, Formatter: "{b}"},
+		}),
+	}
+}
+
+func (g *htmlGraph) newScatter(title string) *charts.Scatter {
+	scatter := charts.NewScatter()
+	scatter.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{Title: title}),
+		charts.WithLegendOpts(opts.Legend{Type: "scroll"}),
+		charts.WithXAxisOpts(opts.XAxis{Name: "Time", Show: true}),
+		charts.WithYAxisOpts(opts.YAxis{Name: fmt.Sprintf("Bytes (%s)", g.accounting), Show: true}),
+		charts.WithDataZoomOpts(opts.DataZoom{
+			Type:  "slider",
+			Start: 0,
+			End:   10,
+		}),
+		charts.WithInitializationOpts(opts.Initialization{PageTitle: "Network microburst charts"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item", TriggerOn: "mousemove|click", Enterable: true}),
+		charts.WithToolboxOpts(opts.Toolbox{Show: true, Feature: &opts.ToolBoxFeature{
+			DataZoom: &opts.ToolBoxFeatureDataZoom{
+				Show: true,
+				Title: map[string]string{
+					"zoom": "zoom",
+					"back": "back",
+				}}}}),
+	)
+	return scatter
+}
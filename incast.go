@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// incastWindow is a window where many sources sent at once
+type incastWindow struct {
+	time    time.Time
+	sources uint64
+	flows   uint64
+	bytes   uint64
+}
+
+// incastStats keeps the windows with at least threshold distinct sources
+type incastStats struct {
+	threshold  uint64
+	windows    uint64
+	maxSources uint64
+	top        []incastWindow
+}
+
+// How many of the incast windows (with most sources) to list at the end
+const INCAST_TOP_WINDOWS = 10
+
+// add records the distinct sources and flows of a window, true if it is an
+// incast window
+func (s *incastStats) add(w incastWindow) bool {
+	if w.sources > s.maxSources {
+		s.maxSources = w.sources
+	}
+
+	if w.sources < s.threshold {
+		return false
+	}
+	s.windows++
+
+	// keep the top windows sorted by the sources, most first
+	i := len(s.top)
+	for i > 0 && s.top[i-1].sources < w.sources {
+		i--
+	}
+	if i < INCAST_TOP_WINDOWS {
+		s.top = append(s.top, incastWindow{})
+		copy(s.top[i+1:], s.top[i:])
+		s.top[i] = w
+		if len(s.top) > INCAST_TOP_WINDOWS {
+			s.top = s.top[:INCAST_TOP_WINDOWS]
+		}
+	}
+
+	return true
+}
+
+func (s *incastStats) print(w io.Writer) {
+	fmt.Fprintf(w, "Incast windows (at least %d sources): %d, max sources in a window: %d\n", s.threshold, s.windows, s.maxSources)
+	for _, t := range s.top {
+		fmt.Fprintf(w, "%s sources: %-6d flows: %-6d rx: %s\n", t.time.Format("15:04:05.000"), t.sources, t.flows, humanize.Bytes(t.bytes))
+	}
+	fmt.Fprintln(w)
+}
+
+func incastWindowOf(s microburst.Sample) incastWindow {
+	return incastWindow{
+		time:    s.Time,
+		sources: s.Sources,
+		flows:   s.Flows,
+		bytes:   s.RxBytes,
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncastStats(t *testing.T) {
+	s := incastStats{threshold: 10}
+	now := time.Unix(0, 0)
+
+	require.False(t, s.add(incastWindow{time: now, sources: 1, flows: 1, bytes: 1000}))
+	for i := 0; i < 2*INCAST_TOP_WINDOWS; i++ {
+		require.True(t, s.add(incastWindow{time: now, sources: uint64(10 + i), flows: uint64(20 + i)}))
+	}
+	require.Equal(t, uint64(2*INCAST_TOP_WINDOWS), s.windows)
+	require.Equal(t, uint64(10+2*INCAST_TOP_WINDOWS-1), s.maxSources)
+	require.Len(t, s.top, INCAST_TOP_WINDOWS)
+	require.Equal(t, s.maxSources, s.top[0].sources)
+	require.Equal(t, uint64(10+INCAST_TOP_WINDOWS), s.top[INCAST_TOP_WINDOWS-1].sources)
+
+	var b bytes.Buffer
+	s.print(&b)
+	require.Contains(t, b.String(), "Incast windows (at least 10 sources): 20, max sources in a window: 29\n")
+}
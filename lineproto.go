@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+const (
+	// the pending lines are written every LINE_FLUSH_INTERVAL, or once
+	// there are LINE_BATCH_LINES of them
+	LINE_FLUSH_INTERVAL = time.Second
+	LINE_BATCH_LINES    = 5000
+	// while the endpoint is down, the oldest lines above LINE_MAX_PENDING
+	// are dropped
+	LINE_MAX_PENDING = 100_000
+	// the lines are packed in datagrams up to this size over udp
+	LINE_UDP_PAYLOAD  = 1400
+	LINE_DIAL_TIMEOUT = 5 * time.Second
+	LINE_MAX_BACKOFF  = 30 * time.Second
+)
+
+// linePoint is a window or a rollup, written as a line of the InfluxDB line
+// protocol or a line per field of the Graphite plaintext protocol
+type linePoint struct {
+	measurement string
+	time        time.Time
+	fields      []lineField
+}
+
+type lineField struct {
+	name  string
+	value uint64
+}
+
+// lineSink writes the windows, or rollups of them, to an InfluxDB or
+// Graphite endpoint or a file. The lines are batched and written in the
+// background, and the connection is dialed again after errors.
+type lineSink struct {
+	format  string
+	host    string
+	iface   string
+	trackRx bool
+	trackTx bool
+	classes []microburst.Class
+	incast  bool
+
+	// rollup is the period of the rollups, 0 writes every window
+	rollup      time.Duration
+	rxThreshold uint64
+	txThreshold uint64
+	rollupEnd   time.Time
+	windows     uint64
+	rx          *windowHist
+	tx          *windowHist
+	rxBursts    uint64
+	txBursts    uint64
+	classSums   []uint64
+	classMax    []uint64
+
+	mu      sync.Mutex
+	pending []string
+	dropped int
+	lastErr error
+	out     *lineOutput
+
+	kick   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newLineSink writes in format (influx or graphite) to target, either
+// tcp://host:port, udp://host:port or a file
+func newLineSink(target string, format string, rollup time.Duration, session microburst.Session, classes []microburst.Class) (*lineSink, error) {
+	if format != "influx" && format != "graphite" {
+		return nil, fmt.Errorf("invalid line format %q, expected influx or graphite", format)
+	}
+	if rollup < 0 {
+		return nil, fmt.Errorf("invalid rollup %s", rollup)
+	}
+	// graphite keeps a value per second, the windows of the same second
+	// would overwrite each other
+	if format == "graphite" {
+		if rollup == 0 {
+			rollup = time.Second
+		}
+		if rollup < time.Second {
+			return nil, fmt.Errorf("invalid rollup %s, graphite needs a rollup of at least 1s", rollup)
+		}
+	}
+	out, err := newLineOutput(target)
+	if err != nil {
+		return nil, err
+	}
+
+	iface := session.Interface
+	if iface == "" {
+		iface = "all"
+	}
+	l := &lineSink{
+		format:      format,
+		host:        session.Host,
+		iface:       iface,
+		trackRx:     session.TrackRx,
+		trackTx:     session.TrackTx,
+		classes:     classes,
+		incast:      session.Incast,
+		rollup:      rollup,
+		rxThreshold: rxThreshold,
+		txThreshold: txThreshold,
+		rx:          newWindowHist(),
+		tx:          newWindowHist(),
+		classSums:   make([]uint64, len(classes)),
+		classMax:    make([]uint64, len(classes)),
+		out:         out,
+		kick:        make(chan struct{}, 1),
+	}
+
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(LINE_FLUSH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-l.kick:
+			case <-l.ctx.Done():
+				return
+			}
+			l.flush()
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *lineSink) OnSample(s microburst.Sample) {
+	if l.rollup == 0 {
+		l.add(l.windowPoint(s))
+		return
+	}
+
+	if !l.rollupEnd.IsZero() && !s.Time.Before(l.rollupEnd) {
+		l.add(l.rollupPoint())
+	}
+	if l.rollupEnd.IsZero() || !s.Time.Before(l.rollupEnd) {
+		l.rollupEnd = s.Time.Truncate(l.rollup).Add(l.rollup)
+	}
+
+	l.windows++
+	if l.trackRx {
+		l.rx.record(s.RxBytes)
+		if s.RxBytes > l.rxThreshold {
+			l.rxBursts++
+		}
+	}
+	if l.trackTx {
+		l.tx.record(s.TxBytes)
+		if s.TxBytes > l.txThreshold {
+			l.txBursts++
+		}
+	}
+	for i, v := range s.Classes {
+		l.classSums[i] += v
+		if v > l.classMax[i] {
+			l.classMax[i] = v
+		}
+	}
+}
+
+func (l *lineSink) OnAnnotation(a microburst.Annotation) {
+}
+
+func (l *lineSink) windowPoint(s microburst.Sample) linePoint {
+	p := linePoint{measurement: "network_microburst", time: s.Time}
+	if l.trackRx {
+		p.fields = append(p.fields, lineField{"rx_bytes", s.RxBytes}, lineField{"rx_packets", s.RxPackets})
+	}
+	if l.trackTx {
+		p.fields = append(p.fields, lineField{"tx_bytes", s.TxBytes}, lineField{"tx_packets", s.TxPackets})
+	}
+	for i, class := range l.classes {
+		p.fields = append(p.fields, lineField{class.Name + "_bytes", s.Classes[i]})
+	}
+	if l.incast {
+		p.fields = append(p.fields, lineField{"sources", s.Sources}, lineField{"flows", s.Flows})
+	}
+	return p
+}
+
+// rollupPoint is the rollup of the windows till rollupEnd, the stats are
+// reset
+func (l *lineSink) rollupPoint() linePoint {
+	p := linePoint{measurement: "network_microburst_rollup", time: l.rollupEnd}
+	hists := []struct {
+		name   string
+		track  bool
+		hist   *windowHist
+		bursts uint64
+	}{
+		{"rx", l.trackRx, l.rx, l.rxBursts},
+		{"tx", l.trackTx, l.tx, l.txBursts},
+	}
+	for _, h := range hists {
+		if !h.track {
+			continue
+		}
+		p.fields = append(p.fields,
+			lineField{h.name + "_max", uint64(h.hist.Max())},
+			lineField{h.name + "_sum", h.hist.sum},
+			lineField{h.name + "_p99", uint64(h.hist.ValueAtQuantile(99))},
+			lineField{h.name + "_bursts", h.bursts},
+		)
+		h.hist.Reset()
+		h.hist.sum = 0
+	}
+	for i, class := range l.classes {
+		p.fields = append(p.fields, lineField{class.Name + "_max", l.classMax[i]}, lineField{class.Name + "_sum", l.classSums[i]})
+		l.classMax[i], l.classSums[i] = 0, 0
+	}
+	p.fields = append(p.fields, lineField{"windows", l.windows})
+	l.windows, l.rxBursts, l.txBursts = 0, 0, 0
+	return p
+}
+
+// add queues the lines of the point, and wakes up the writer once there is
+// a batch
+func (l *lineSink) add(p linePoint) {
+	var lines []string
+	if l.format == "influx" {
+		lines = []string{influxLine(p, l.host, l.iface)}
+	} else {
+		lines = graphiteLines(p, l.host, l.iface)
+	}
+
+	l.mu.Lock()
+	l.pending = append(l.pending, lines...)
+	full := len(l.pending) >= LINE_BATCH_LINES
+	l.mu.Unlock()
+
+	if full {
+		select {
+		case l.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the pending lines, they are kept for the next flush if the
+// endpoint is down
+func (l *lineSink) flush() {
+	l.mu.Lock()
+	lines := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	err := l.out.write(lines)
+	if err == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastErr = err
+	l.pending = append(lines, l.pending...)
+	if over := len(l.pending) - LINE_MAX_PENDING; over > 0 {
+		l.dropped += over
+		l.pending = l.pending[over:]
+	}
+}
+
+// Close writes the last rollup and the pending lines
+func (l *lineSink) Close() error {
+	if l.rollup > 0 && !l.rollupEnd.IsZero() {
+		l.add(l.rollupPoint())
+	}
+	l.cancel()
+	l.wg.Wait()
+	// one last try, even if the endpoint was down
+	l.out.nextDial = time.Time{}
+	l.flush()
+
+	var errs []error
+	if len(l.pending) > 0 {
+		errs = append(errs, fmt.Errorf("%d lines not written: %w", len(l.pending), l.lastErr))
+	}
+	if l.dropped > 0 {
+		errs = append(errs, fmt.Errorf("%d lines dropped while %s was down", l.dropped, l.out.target))
+	}
+	errs = append(errs, l.out.close())
+	return errors.Join(errs...)
+}
+
+// influxLine is the point in the InfluxDB line protocol, with nanosecond
+// timestamps
+func influxLine(p linePoint, host string, iface string) string {
+	var b strings.Builder
+	b.WriteString(p.measurement)
+	fmt.Fprintf(&b, ",host=%s,interface=%s ", influxEscape(host), influxEscape(iface))
+	for i, f := range p.fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%di", influxEscape(f.name), f.value)
+	}
+	fmt.Fprintf(&b, " %d", p.time.UnixNano())
+	return b.String()
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func influxEscape(s string) string {
+	return influxEscaper.Replace(s)
+}
+
+// graphiteLines are the fields of the point in the Graphite plaintext
+// protocol, as measurement.host.interface.field. Graphite has second
+// timestamps, so only rollups of at least a second are written this way.
+func graphiteLines(p linePoint, host string, iface string) []string {
+	prefix := p.measurement + "." + graphiteEscape(host) + "." + graphiteEscape(iface) + "."
+	lines := make([]string, len(p.fields))
+	for i, f := range p.fields {
+		lines[i] = fmt.Sprintf("%s%s %d %d", prefix, graphiteEscape(f.name), f.value, p.time.Unix())
+	}
+	return lines
+}
+
+// graphiteEscape replaces everything but letters, digits, - and _ with _
+func graphiteEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// lineOutput is a tcp or udp connection or a file, dialed (or opened) on
+// the first write and again after errors, with a backoff
+type lineOutput struct {
+	target   string
+	network  string
+	addr     string
+	w        io.WriteCloser
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+func newLineOutput(target string) (*lineOutput, error) {
+	o := &lineOutput{target: target}
+	if network, addr, ok := strings.Cut(target, "://"); ok {
+		switch network {
+		case "tcp", "udp":
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid line output %q: %w", target, err)
+			}
+		case "file":
+		default:
+			return nil, fmt.Errorf("invalid line output %q, expected tcp://, udp:// or a file", target)
+		}
+		o.network, o.addr = network, addr
+	} else {
+		o.network, o.addr = "file", target
+	}
+
+	// fail early on a file that can't be written
+	if o.network == "file" {
+		if err := o.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *lineOutput) connect() error {
+	var err error
+	if o.network == "file" {
+		o.w, err = os.OpenFile(o.addr, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	} else {
+		o.w, err = net.DialTimeout(o.network, o.addr, LINE_DIAL_TIMEOUT)
+	}
+	return err
+}
+
+func (o *lineOutput) write(lines []string) error {
+	if o.w == nil {
+		if time.Now().Before(o.nextDial) {
+			return fmt.Errorf("%s is down, retrying in %s", o.target, time.Until(o.nextDial).Round(time.Second))
+		}
+		if err := o.connect(); err != nil {
+			o.retryLater()
+			return err
+		}
+	}
+
+	var err error
+	if o.network == "udp" {
+		err = writeDatagrams(o.w, lines)
+	} else {
+		_, err = io.WriteString(o.w, strings.Join(lines, "\n")+"\n")
+	}
+	if err != nil {
+		o.w.Close()
+		o.w = nil
+		o.retryLater()
+		return err
+	}
+	o.backoff = 0
+	return nil
+}
+
+// retryLater doubles the time till the next dial, up to LINE_MAX_BACKOFF
+func (o *lineOutput) retryLater() {
+	o.backoff *= 2
+	if o.backoff == 0 {
+		o.backoff = time.Second
+	}
+	if o.backoff > LINE_MAX_BACKOFF {
+		o.backoff = LINE_MAX_BACKOFF
+	}
+	o.nextDial = time.Now().Add(o.backoff)
+}
+
+func (o *lineOutput) close() error {
+	if o.w == nil {
+		return nil
+	}
+	return o.w.Close()
+}
+
+// writeDatagrams packs the lines in datagrams of up to LINE_UDP_PAYLOAD
+// bytes, a longer line is sent alone
+func writeDatagrams(w io.Writer, lines []string) error {
+	var b bytes.Buffer
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+len(line)+1 > LINE_UDP_PAYLOAD {
+			if _, err := w.Write(b.Bytes()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	if b.Len() > 0 {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	return nil
+}
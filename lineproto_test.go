@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+func TestLineSinkInflux(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	received := make(chan []string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	session := microburst.Session{Host: "db 1", TrackRx: true, TrackTx: true}
+	classes := []microburst.Class{{Name: "rx:dscp=ef"}}
+	sink, err := newLineSink("tcp://"+l.Addr().String(), "influx", 0, session, classes)
+	require.NoError(t, err)
+
+	runSynthetic(t, `
+classes rx:dscp=ef
+1500000/1000 64/1 1000 x2
+`, sink)
+	require.NoError(t, sink.Close())
+
+	require.Equal(t, []string{
+		`network_microburst,host=db\ 1,interface=all rx_bytes=1500000i,rx_packets=1000i,tx_bytes=64i,tx_packets=1i,rx:dscp\=ef_bytes=1000i 1672567200000000000`,
+		`network_microburst,host=db\ 1,interface=all rx_bytes=1500000i,rx_packets=1000i,tx_bytes=64i,tx_packets=1i,rx:dscp\=ef_bytes=1000i 1672567200001000000`,
+	}, <-received)
+}
+
+func TestLineSinkGraphiteRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollups.txt")
+	session := microburst.Session{Host: "db1.example.com", Interface: "eth0", TrackRx: true}
+	sink, err := newLineSink(path, "graphite", time.Second, session, nil)
+	require.NoError(t, err)
+	sink.rxThreshold = 100_000
+
+	// 1000 windows in the first second and 500 in the next
+	runSynthetic(t, `
+1000 0 x998
+1500000 0 x2
+2000 0 x500
+`, sink)
+	require.NoError(t, sink.Close())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	prefix := "network_microburst_rollup.db1_example_com.eth0."
+	require.Equal(t, []string{
+		prefix + "rx_max 1500159 1672567201",
+		prefix + "rx_sum 3998000 1672567201",
+		prefix + "rx_p99 1000 1672567201",
+		prefix + "rx_bursts 2 1672567201",
+		prefix + "windows 1000 1672567201",
+		prefix + "rx_max 2000 1672567202",
+		prefix + "rx_sum 1000000 1672567202",
+		prefix + "rx_p99 2000 1672567202",
+		prefix + "rx_bursts 0 1672567202",
+		prefix + "windows 500 1672567202",
+	}, lines)
+}
+
+func TestLineSinkGraphiteNeedsRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollups.txt")
+	session := microburst.Session{Host: "db1.example.com", TrackRx: true}
+	_, err := newLineSink(path, "graphite", 100*time.Millisecond, session, nil)
+	require.ErrorContains(t, err, "at least 1s")
+
+	sink, err := newLineSink(path, "graphite", 0, session, nil)
+	require.NoError(t, err)
+	require.Equal(t, time.Second, sink.rollup)
+	require.NoError(t, sink.Close())
+}
+
+func TestLineOutputReconnect(t *testing.T) {
+	// nothing listens on the port at first
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	out, err := newLineOutput("tcp://" + addr)
+	require.NoError(t, err)
+	require.Error(t, out.write([]string{"a"}))
+	require.Error(t, out.write([]string{"a"}), "retried before the backoff")
+
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer l.Close()
+	out.nextDial = time.Time{}
+	require.NoError(t, out.write([]string{"a", "b"}))
+	require.NoError(t, out.close())
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = conn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "a\nb\n", string(b))
+
+	_, err = newLineOutput("http://localhost:8086")
+	require.Error(t, err)
+}
+
+type datagrams [][]byte
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestWriteDatagrams(t *testing.T) {
+	var d datagrams
+	line := strings.Repeat("x", 600)
+	require.NoError(t, writeDatagrams(&d, []string{line, line, line, strings.Repeat("y", 2000)}))
+	require.Len(t, d, 3)
+	require.Len(t, d[0], 2*601)
+	require.Len(t, d[1], 601)
+	require.Len(t, d[2], 2001)
+}
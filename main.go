@@ -3,102 +3,178 @@ package main
 import (
 	"C"
 	"context"
-	_ "embed"
-	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/HdrHistogram/hdrhistogram-go"
-	"github.com/aquasecurity/libbpfgo"
 	bpf "github.com/aquasecurity/libbpfgo"
 	"github.com/aquasecurity/libbpfgo/helpers"
-	"github.com/dustin/go-humanize"
-	"github.com/prometheus/procfs"
-	"golang.org/x/sys/unix"
+	"github.com/mum4k/termdash/terminal/tcell"
+	"github.com/surki/network-microburst/pkg/microburst"
 )
 
 var (
 	debug             bool
-	filterInterface   string
-	burstWindow       time.Duration
+	options           = microburst.DefaultOptions()
 	rxThreshold       uint64
 	txThreshold       uint64
 	printHistogram    bool
 	showGraph         bool
 	saveGraphHtmlPath string
-	trackRx           bool
-	trackTx           bool
 	ctx               context.Context
 	cancel            context.CancelFunc
-	statsChan         = make(chan rxTxStats, 500)
 	wg                sync.WaitGroup
-	chrt              *chart
-	timerHist         *hdrhistogram.Histogram
-	timerToUse        string
-	perfTimerCpu      int
+	printWindows      bool
 	cpuProfile        string
 	memProfile        string
+	filterFile        string
+	controlSocket     string
+	burstBytes        uint64
+	incastSources     uint64
+	collector         *microburst.Collector
+	synthetic         string
+	recordPath        string
+	outputFormat      string
+	outputPath        string
+	listenAddr        string
+	otlpEndpoint      string
+	otlpInterval      time.Duration
+	lineOutputTarget  string
+	lineFormat        string
+	lineRollup        time.Duration
+	classes           []microburst.Class
+	// info is where the messages and the summary go, stderr when the
+	// values are printed to stdout as csv or jsonl
+	info io.Writer = os.Stdout
+	// cmdlineFilters are the filters on the command line, filter-file is
+	// applied on top of them
+	cmdlineFilters microburst.Filters
 )
 
-type rxTxStats struct {
-	rxBytes uint64
-	txBytes uint64
-	time    time.Time
-}
-
-var bpfBin []byte
-
-//go:embed network-microburst.bpf.o
-var defaultBpfBin []byte
-
-//go:embed network-microburst.bpf.per_cpu_legacy.o
-var userspaceTimerBpfBin []byte
-var goTimerOnly bool
-var bpfName string
-
-const defaultBpfName = "network-microburst.bpf.o"
-const userspaceTimerBpfName = "network-microburst.bpf.per_cpu_legacy.o"
-
 func init() {
 	flag.BoolVar(&debug, "debug", false, "enable debug logs")
-	flag.StringVar(&filterInterface, "filter-interface", "", "network interface to track, by default all interfaces are tracked")
-	flag.DurationVar(&burstWindow, "burst-window", 1*time.Millisecond, "microburst window to track, the metrics are tracked by this granularity")
+	flag.StringVar(&options.Filters.Interface, "filter-interface", "", "network interface to track, by default all interfaces are tracked. with attach=tc or attach=xdp, this is required and can be a comma separated list")
+	flag.DurationVar(&options.Window, "burst-window", 1*time.Millisecond, "microburst window to track, the metrics are tracked by this granularity")
 	flag.BoolVar(&showGraph, "show-graph", true, "plot the rate in the TUI graph. If this is set to false, the values are printed to stdout")
+	flag.BoolVar(&printWindows, "print", false, "print the values to stdout, along with the other outputs. the TUI uses the terminal, so redirect stdout with show-graph. implied by show-graph=false")
+	flag.StringVar(&outputFormat, "output", "text", "format of the printed values: text, csv or jsonl. csv and jsonl have the raw bytes, nanosecond timestamps and the measured window (csv leaves out the annotations)")
+	flag.StringVar(&listenAddr, "listen", "", "serve the Prometheus metrics on /metrics at this `address`, like :9465. the burst windows are the ones above print-rx-threshold and print-tx-threshold")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "push the histograms of the window bytes as OTLP exponential histograms to this OpenTelemetry collector `url` (OTLP/HTTP with JSON, like http://localhost:4318)")
+	flag.DurationVar(&otlpInterval, "otlp-interval", 10*time.Second, "how often to push to otlp-endpoint")
+	flag.StringVar(&lineOutputTarget, "line-output", "", "write the windows in the InfluxDB line protocol or Graphite plaintext to this `target`: tcp://host:port, udp://host:port or a file. batched and reconnected in the background")
+	flag.StringVar(&lineFormat, "line-format", "influx", "format of line-output: influx or graphite")
+	flag.DurationVar(&lineRollup, "line-rollup", 0, "write rollups of this period (max, sum, p99 and the windows above print-rx-threshold/print-tx-threshold) to line-output instead of every window, like 1s. graphite needs at least 1s, and defaults to it")
+	flag.StringVar(&outputPath, "output-file", "", "print the values to this `file` instead of stdout, along with the other outputs")
 	flag.Uint64Var(&rxThreshold, "print-rx-threshold", 0, "rx threshold for printing, only values greater than this are printed. used when show-graph=false")
 	flag.Uint64Var(&txThreshold, "print-tx-threshold", 0, "tx threshold for printing, only values greater than this are printed. used when show-graph=false")
 	flag.BoolVar(&printHistogram, "print-histogram", false, "display histogram at the end")
 	flag.StringVar(&saveGraphHtmlPath, "save-graph-html", "", "save the plot to the given HTML file for offline analysis")
-	flag.BoolVar(&trackRx, "track-rx", true, "track network receives")
-	flag.BoolVar(&trackTx, "track-tx", true, "track network transfers")
-	flag.StringVar(&timerToUse, "timer", "perf", "timer to use for tracking microbursts. can be either perf or go")
-	flag.IntVar(&perfTimerCpu, "perf-cpu", -1, "cpu to use for perf timer. used only when timer=perf")
+	flag.BoolVar(&options.TrackRx, "track-rx", true, "track network receives")
+	flag.BoolVar(&options.TrackTx, "track-tx", true, "track network transfers")
+	flag.StringVar(&options.Timer, "timer", "auto", "timer to use for tracking microbursts. can be either auto, perf, perf-percpu, go or bpf. auto picks the best one supported by the kernel")
+	flag.StringVar(&options.Attach, "attach", "auto", "how to trace network receives/transmits. can be either auto, tp_btf, raw_tp, kprobe, tc or xdp. auto picks the best one supported by the kernel. tc and xdp attach to the interfaces given by filter-interface (xdp uses tc for transmits)")
+	flag.BoolVar(&options.GsoSegments, "gso-segments", false, "account GSO/GRO packets as the segments on the wire, i.e., count each segment as a packet and include the headers replicated in each segment")
+	flag.StringVar(&options.Accounting, "accounting", "skb", "what the bytes include. can be either skb (skb->len as seen by the hook, i.e., IP packet on receive and ethernet frame without FCS on transmit), l3 (IP packet), l2 (ethernet frame, including header and FCS) or wire (l2 plus preamble, inter frame gap and minimum frame padding, GSO packets are accounted per segment)")
+	flag.StringVar(&options.BtfPath, "btf-path", "", "external BTF file to use for CO-RE relocations, for kernels without /sys/kernel/btf/vmlinux")
+	flag.StringVar(&options.BtfDir, "btf-dir", "", "directory to look up the BTF file matching the running kernel in, either <release>.btf or BTFHub layout. used when btf-path is not given")
+	flag.StringVar(&options.Filters.SrcCidr, "src-cidr", "", "comma separated list of IPv4/IPv6 CIDRs, track only the packets from these")
+	flag.StringVar(&options.Filters.DstCidr, "dst-cidr", "", "comma separated list of IPv4/IPv6 CIDRs, track only the packets to these")
+	flag.StringVar(&options.Filters.Port, "port", "", "comma separated list of ports or port ranges (like 443,8000-8100), track only the tcp/udp/sctp packets from or to these")
+	flag.StringVar(&options.RxClasses, "rx-classes", "", "comma separated list of received traffic classes to track as separate series: unicast, broadcast, multicast, otherhost (by packet type), local and forwarded (by routing result)")
+	flag.StringVar(&options.DscpGroups, "dscp-groups", "", "comma separated list of DSCP codepoints (like ef,af41,0) to track as separate series")
+	flag.StringVar(&options.PriorityGroups, "priority-groups", "", "comma separated list of skb priorities or tc classids (like 1:10,6) to track as separate series")
+	flag.StringVar(&options.Filters.Mark, "mark", "", "track only the packets whose skb->mark (fwmark) matches the `value[/mask]`, like 0x100/0xff00. applies only to the transmitted packets, the received ones are not marked yet")
+	flag.StringVar(&options.MarkGroups, "mark-groups", "", "comma separated list of skb->mark values (like 0x100/0xff00,0x200/0xff00, all with the same mask) to track the transmitted bytes of as separate series")
+	flag.BoolVar(&options.Decap, "decap", false, "account the VXLAN, Geneve, GRE and IPIP packets by their inner headers, i.e., the filters and groups see the encapsulated packet")
+	flag.StringVar(&options.VniGroups, "vni-groups", "", "comma separated list of VXLAN/Geneve VNIs or GRE keys to track as separate series, needs decap")
+	flag.BoolVar(&options.PacketSizes, "packet-sizes", false, "track the packet size (log2) histogram of each window, the mix of tiny, MTU sized and GSO/GRO packets in the burst and the idle windows is shown at the end")
+	flag.Uint64Var(&burstBytes, "burst-bytes", 0, "windows with more bytes than this are bursts for packet-sizes, 0 means more than twice the mean of the windows with traffic")
+	flag.BoolVar(&options.Incast, "incast", false, "estimate the distinct sources and flows of the received packets in each window, to tell incast (many senders at once) from a single elephant flow")
+	flag.Uint64Var(&incastSources, "incast-sources", 32, "windows with at least this many distinct sources are flagged as incast. used with incast")
+	flag.StringVar(&filterFile, "filter-file", "", "file with the filters to use (\"interface <name>\", \"src-cidr <cidrs>\", \"dst-cidr <cidrs>\", \"port <ports>\", \"mark <value/mask>\" and \"filter <expression>\" lines), overrides the command line ones. reloaded on SIGHUP or R key in the TUI")
+	flag.StringVar(&controlSocket, "control-socket", "", "unix socket `path` to accept filter changes on (same lines as filter-file, or \"show\")")
+	flag.IntVar(&options.PerfCpu, "perf-cpu", -1, "cpu to use for perf timer. used only when timer=perf")
+	flag.StringVar(&synthetic, "synthetic", "", "replay a synthetic `pattern` (steady, bursts or random, for 10 seconds) or script file in real time instead of tracing the kernel, to try the outputs without root")
 	flag.StringVar(&cpuProfile, "cpuprofile", "", "write cpu profile to `file`")
 	flag.StringVar(&memProfile, "memprofile", "", "write memory profile to `file`")
-	osInfo, _ := helpers.GetOSInfo()
-	bpfBin = defaultBpfBin
-	bpfName = defaultBpfName
-	if age, _ := osInfo.CompareOSBaseKernelRelease("5.19.0"); helpers.KernelVersionNewer == age {
-		fmt.Printf("warning: perf timer not supported, use kernel version older than 5.19.0. falling back to go timer.\n")
-		timerToUse = "go"
-		bpfBin = userspaceTimerBpfBin
-		bpfName = userspaceTimerBpfName
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [filter expression]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s record -o <file> [flags] [filter expression]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s replay [flags] <file>\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "record also writes the windows to a compressed file, replay feeds the file back to the outputs (in real time with show-graph, otherwise as fast as they are consumed)\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "The filter expression is a subset of the pcap-filter syntax, like 'tcp port 443 and host 10.0.0.5'\n\n")
+		flag.PrintDefaults()
 	}
 }
 
-var btime uint64 = 0
-var numCpus int = -1
-
 func main() {
+	var mode string
+	if len(os.Args) > 1 && (os.Args[1] == "record" || os.Args[1] == "replay") {
+		mode = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if mode == "record" {
+		flag.StringVar(&recordPath, "o", "", "write the recording to `file`")
+	}
 	flag.Parse()
+	if mode == "record" && recordPath == "" {
+		panic("record needs the output file (-o)")
+	}
+
+	switch outputFormat {
+	case "text":
+	case "csv", "jsonl":
+		if outputPath == "" {
+			info = os.Stderr
+		}
+	default:
+		panic(fmt.Sprintf("invalid output %q, expected text, csv or jsonl", outputFormat))
+	}
+
+	options.Debug = debug
+	options.Filters.Expr = strings.Join(flag.Args(), " ")
+	var source microburst.Source
+	var err error
+	if mode == "replay" {
+		if flag.NArg() != 1 {
+			panic("replay needs the recording file")
+		}
+		if synthetic != "" || filterFile != "" || controlSocket != "" {
+			panic("synthetic, filter-file and control-socket are not supported with replay")
+		}
+		source, err = newReplaySource(flag.Arg(0))
+	} else if synthetic != "" {
+		if filterFile != "" || controlSocket != "" {
+			panic("filter-file and control-socket are not supported with synthetic")
+		}
+		source, err = newSyntheticSource(synthetic, options.Window)
+	} else {
+		collector, err = newCollector()
+		source = collector
+	}
+	if err != nil {
+		panic(err)
+	}
+	classes = source.Classes()
+
+	var recorder *microburst.Recorder
+	if recordPath != "" {
+		recorder, err = microburst.CreateRecording(recordPath, sessionOf(source))
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	if cpuProfile != "" {
 		f, err := os.Create(cpuProfile)
@@ -112,25 +188,6 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	fs, err := procfs.NewFS("/proc")
-	stats, err := fs.Stat()
-	if err != nil {
-		panic(err)
-	}
-	btime = stats.BootTime
-
-	// We will calculate num cpus from /proc/cpuinfo, as we may be
-	// running under taskset to run on a subset of cpus and
-	// runtime.NumCPU() will not show all the physical cpus, which we
-	// require in bpf code
-	cpus, err := fs.CPUInfo()
-	if err != nil {
-		panic(err)
-	}
-	numCpus = len(cpus)
-
-	statsInit()
-
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
@@ -144,133 +201,147 @@ func main() {
 		}
 	}()
 
-	bpf.SetLoggerCbs(bpf.Callbacks{
-		Log: func(level int, msg string) {
-			if debug {
-				log.Printf("%s", msg)
-			}
-		},
-	})
-	module, err := bpf.NewModuleFromBuffer(bpfBin, bpfName)
+	err = source.Start(ctx)
 	if err != nil {
 		panic(err)
 	}
-	defer module.Close()
+	// The source stops on its own at the end or on errors, Stop returns
+	// the error below
+	go func() {
+		<-source.Done()
+		cancel()
+	}()
 
-	if filterInterface != "" {
-		if len(filterInterface) > 16 {
-			panic("network interfaces with more than 16 bytes not supported")
-		}
-		err = module.InitGlobalVariable("ifname", []byte(filterInterface))
-		if err != nil {
-			panic(err)
-		}
-		err = module.InitGlobalVariable("filter_dev", uint8(1))
+	if controlSocket != "" {
+		l, err := serveControl(controlSocket, collector)
 		if err != nil {
 			panic(err)
 		}
+		defer l.Close()
 	}
 
-	err = module.InitGlobalVariable("nr_cpus", uint32(numCpus))
-	if err != nil {
-		panic(err)
+	if filterFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-hup:
+					reloadFilters()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
 	}
 
-	err = module.BPFLoadObject()
-	if err != nil {
-		panic(err)
+	if debug {
+		go helpers.TracePipeListen()
 	}
 
-	if trackRx {
-		prog, err := module.GetProgram("trace_network_receive")
+	var promMetrics *metrics
+	if listenAddr != "" {
+		var dropped func() uint64
+		if collector != nil {
+			dropped = collector.Dropped
+		}
+		// the interface the windows came from, also when replaying
+		promMetrics = newMetrics(sessionOf(source).Interface, dropped)
+		srv, err := serveMetrics(listenAddr, promMetrics)
 		if err != nil {
 			panic(err)
 		}
-		if debug {
-			log.Printf("attaching program %q", prog.Name())
-		}
+		defer srv.Close()
+	}
 
-		_, err = prog.AttachGeneric()
+	var otlp *otlpExporter
+	if otlpEndpoint != "" {
+		otlp, err = newOtlpExporter(otlpEndpoint, otlpInterval, sessionOf(source), classes)
 		if err != nil {
-			panic(fmt.Sprintf("failed to attach program (%s): %v", prog.Name(), err))
+			panic(err)
 		}
 	}
 
-	if trackTx {
-		prog, err := module.GetProgram("trace_network_transmit")
+	var lines *lineSink
+	if lineOutputTarget != "" {
+		lines, err = newLineSink(lineOutputTarget, lineFormat, lineRollup, sessionOf(source), classes)
 		if err != nil {
 			panic(err)
 		}
-		if debug {
-			log.Printf("attaching program %q", prog.Name())
-		}
-		_, err = prog.AttachGeneric()
-		if err != nil {
-			panic(fmt.Sprintf("failed to attach program (%s): %v", prog.Name(), err))
-		}
-	}
-
-	if debug {
-		go helpers.TracePipeListen()
 	}
 
+	// The TUI goes first, so that the terminal is restored before the
+	// others print at the end
+	var sinks microburst.Fanout
 	if showGraph {
-		chrt, err = newChart(trackRx, trackTx, burstWindow)
+		var incastThreshold uint64
+		if options.Incast {
+			incastThreshold = incastSources
+		}
+		t, err := tcell.New()
 		if err != nil {
 			panic(err)
 		}
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			chrt.run()
-		}()
-	}
-	if timerToUse == "perf" {
-		perfFd, rb, err := setupPerfTimer(module)
+		chrt, err := newChart(t, options.TrackRx, options.TrackTx, classes, options.Window, options.Accounting, incastThreshold)
 		if err != nil {
 			panic(err)
 		}
-		defer func() {
-			if err := syscall.Close(perfFd); err != nil {
+		sinks = append(sinks, chrt)
+	}
+	sinks = append(sinks, newSummary(info, classes))
+	if saveGraphHtmlPath != "" {
+		sinks = append(sinks, newHtmlGraph(saveGraphHtmlPath, classes, options.Window))
+	}
+	if printWindows || !showGraph || outputPath != "" {
+		w := os.Stdout
+		if outputPath != "" {
+			w, err = os.Create(outputPath)
+			if err != nil {
 				panic(err)
 			}
-			rb.Close()
-		}()
-	} else if timerToUse == "go" {
-		err := setupGoTimer(module)
+			defer w.Close()
+		}
+		out, err := newOutput(outputFormat, w, classes, options.Window)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		panic(fmt.Sprintf("invalid timer option %q", timerToUse))
+		sinks = append(sinks, out)
+	}
+	if recorder != nil {
+		sinks = append(sinks, recorder)
+	}
+	if promMetrics != nil {
+		sinks = append(sinks, promMetrics)
+	}
+	if otlp != nil {
+		sinks = append(sinks, otlp)
+	}
+	if lines != nil {
+		sinks = append(sinks, lines)
 	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		handleStats()
+		microburst.Dispatch(ctx, source, sinks)
 	}()
 
 	<-ctx.Done()
 
-	fmt.Printf("\nwaiting for workers to finish...\n")
+	fmt.Fprintf(info, "\nwaiting for workers to finish...\n")
 
 	wg.Wait()
-
-	if chrt != nil {
-		chrt.stop()
+	err = source.Stop()
+	// a recording cut short is replayed till there
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Fprintf(info, "warning: %v\n", err)
+		err = nil
 	}
-
-	fmt.Println("")
-
-	statsFinish()
-
-	if !showGraph {
-		fmt.Printf("Timer accuracy: \n")
-		fmt.Printf("Mean: %v StdDev: %v Min: %v Max: %v\n", time.Duration(timerHist.Mean()), time.Duration(int64(timerHist.StdDev())), time.Duration(timerHist.Min()), time.Duration(timerHist.Max()))
-		fmt.Printf("Histogram:\n")
-		fmt.Println(getHistogram(timerHist, func(v float64) string { return time.Duration(int64(v)).String() }))
+	if closeErr := sinks.Close(); closeErr != nil {
+		log.Printf("%v", closeErr)
+	}
+	if err != nil {
+		panic(err)
 	}
 
 	if memProfile != "" {
@@ -286,248 +357,122 @@ func main() {
 	}
 }
 
-func handleStats() {
-	timerHist = hdrhistogram.New(1, int64(10_000_000_000), 5)
-
-	var lastTime time.Time
-
-	for {
-		var s rxTxStats
-
-		select {
-		case <-ctx.Done():
-			return
-		case s = <-statsChan:
-		}
-
-		if trackRx {
-			statsHandleRxData(s.time, s.rxBytes)
+// newCollector creates the collector of the bpf programs, as given by the
+// flags
+func newCollector() (*microburst.Collector, error) {
+	var err error
+	cmdlineFilters = options.Filters
+	if filterFile != "" {
+		options.Filters, err = microburst.ReadFilterFile(filterFile, cmdlineFilters)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if trackTx {
-			statsHandleTxData(s.time, s.txBytes)
-		}
+	c, err := microburst.New(options)
+	if err != nil {
+		return nil, err
+	}
 
-		timerAccuracy := s.time.Sub(lastTime)
-		lastTime = s.time
-		timerHist.RecordValue(int64(timerAccuracy))
+	backend := c.Backend()
+	fmt.Fprintf(info, "kernel features: %s\n", backend.Features)
+	if options.Timer != "auto" && options.Timer != backend.Timer {
+		fmt.Fprintf(info, "warning: %s, falling back to %s timer\n", backend.Reason, backend.Timer)
+	}
+	fmt.Fprintf(info, "using %s timer with %s (%s)\n", backend.Timer, backend.Object, backend.Reason)
+	fmt.Fprintf(info, "using %s programs for tracing, accounting %s bytes\n", backend.Attach, options.Accounting)
+	fmt.Fprintf(info, "tracking %s\n", options.Filters)
+	if options.Decap && options.Filters.Interface == "" {
+		fmt.Fprintf(info, "warning: with decap and no filter-interface the tunneled packets are counted twice, on the underlay and on the tunnel device\n")
+	}
+	if backend.BtfPath != "" {
+		fmt.Fprintf(info, "using external BTF %s\n", backend.BtfPath)
+	}
 
-		if showGraph {
-			if trackTx {
-				chrt.updateTxData(s.txBytes, s.time)
-			}
-			if trackRx {
-				chrt.updateRxData(s.rxBytes, s.time)
-			}
-		} else {
-			var rx, tx string
-			var print bool
-			if trackRx && s.rxBytes > rxThreshold {
-				rx = humanize.Bytes(s.rxBytes)
-				print = true
-			} else {
-				rx = "-"
-			}
-			if trackTx && s.txBytes > txThreshold {
-				tx = humanize.Bytes(s.txBytes)
-				print = true
-			} else {
-				tx = "-"
+	bpf.SetLoggerCbs(bpf.Callbacks{
+		Log: func(level int, msg string) {
+			if debug {
+				log.Printf("%s", msg)
 			}
+		},
+	})
 
-			if print {
-				fmt.Printf("%s [%10v]: rx: %-10s tx: %-10s\n", s.time.Format("15:04:05.000"), timerAccuracy, rx, tx)
-			}
-		}
-	}
+	return c, nil
 }
 
-func getRxTxValues(txrxInfo *bpf.BPFMap) (uint64, uint64, error) {
-	var received, transferred uint64
-
-	if trackRx {
-		key := 0
-		values := make([]byte, 8*numCpus)
-		err := txrxInfo.GetValueReadInto(unsafe.Pointer(&key), &values)
-		if err != nil {
-			return 0, 0, err
-		}
-		last := 0
-		for i := 0; i < numCpus; i++ {
-			cnt := binary.LittleEndian.Uint64(values[last : last+8])
-			last += 8
-			received += cnt
-		}
+// newSyntheticSource replays the given pattern or script file
+func newSyntheticSource(pattern string, window time.Duration) (*microburst.Synthetic, error) {
+	src := &microburst.Synthetic{
+		Window:   window,
+		Realtime: true,
 	}
 
-	if trackTx {
-		key := 1
-		values := make([]byte, 8*numCpus)
-		err := txrxInfo.GetValueReadInto(unsafe.Pointer(&key), &values)
-		if err != nil {
-			return 0, 0, err
-		}
-
-		last := 0
-		for i := 0; i < numCpus; i++ {
-			cnt := binary.LittleEndian.Uint64(values[last : last+8])
-			last += 8
-			transferred += uint64(cnt)
-		}
+	if gen, ok := microburst.Patterns[pattern]; ok {
+		src.Script = gen(int(10 * time.Second / window))
+		fmt.Fprintf(info, "replaying synthetic %s pattern\n", pattern)
+		return src, nil
 	}
 
-	return received, transferred, nil
-}
-
-func setupPerfTimer(module *libbpfgo.Module) (int, *libbpfgo.RingBuffer, error) {
-	prog, err := module.GetProgram("calc_metrics")
+	f, err := os.Open(pattern)
 	if err != nil {
-		return -1, nil, fmt.Errorf("error getting program for calc_metrics: %w", err)
-	}
-
-	cpuChosen := chooseCpuForPerfTimer()
-	fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
-		Type:   unix.PERF_TYPE_SOFTWARE,
-		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-		// We will use periodic sampling, we will not use the frequency
-		Sample: uint64(burstWindow.Nanoseconds()),
-		// Sample: uint64(1_000_0),
-		// Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-	}, -1, cpuChosen, -1, 0)
-	if err != nil {
-		return -1, nil, fmt.Errorf("open perf event: %w", err)
+		return nil, err
 	}
+	defer f.Close()
 
-	_, err = prog.AttachPerfEvent(fd)
+	src.Script, src.Series, err = microburst.ReadScript(f)
 	if err != nil {
-		_ = syscall.Close(fd)
-		return -1, nil, fmt.Errorf("failed to attach program (%s): %v", prog.Name(), err)
-	}
-
-	if debug {
-		log.Printf("setup perf timer on cpu %d with %s periodic sampling", cpuChosen, burstWindow)
+		return nil, fmt.Errorf("%s: %w", pattern, err)
 	}
+	fmt.Fprintf(info, "replaying synthetic script %s\n", pattern)
+	return src, nil
+}
 
-	eventsChannel := make(chan []byte)
-	rb, err := module.InitRingBuf("events", eventsChannel)
-	if err != nil {
-		return -1, nil, fmt.Errorf("init ringbuf: %w", err)
+// sessionOf is the metadata of the source, for the recordings and the
+// exporters
+func sessionOf(src microburst.Source) microburst.Session {
+	switch src := src.(type) {
+	case *microburst.Collector:
+		return src.Session()
+	case *microburst.Replay:
+		return src.Session()
+	default:
+		session := microburst.NewSession(options, classes)
+		session.Timer = "synthetic"
+		return session
 	}
-
-	rb.Poll(300)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		for {
-			select {
-			case b := <-eventsChannel:
-				ts := binary.LittleEndian.Uint64(b[0:8])
-				currRx := binary.LittleEndian.Uint64(b[8:16])
-				currTx := binary.LittleEndian.Uint64(b[16:24])
-
-				n := time.Unix(int64(btime), int64(ts))
-
-				select {
-				case statsChan <- rxTxStats{
-					rxBytes: currRx,
-					txBytes: currTx,
-					time:    n,
-				}:
-				default:
-					// log.Printf("dropping stats update")
-				}
-
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	return fd, rb, nil
 }
 
-func setupGoTimer(module *libbpfgo.Module) error {
-	txrxInfo, err := module.GetMap("txrx_info")
+// newReplaySource replays the recording at path, the options are set to the
+// ones it was recorded with
+func newReplaySource(path string) (*microburst.Replay, error) {
+	src, err := microburst.OpenReplay(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		var lastRx, lastTx uint64
-
-		for {
-			// TODO: we rely on the go timer for calculating
-			// rate, so our burst rate calculation is going to
-			// be only as good as its granularity/accuracy. The
-			// right thing to do is to compute this in the bpf
-			// code itself (using bpf_timer etc) and then
-			// publish that over perf event channel.
-			//
-			time.Sleep(burstWindow)
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			n := time.Now()
-
-			currRx, currTx, err := getRxTxValues(txrxInfo)
-			if err != nil {
-				panic(err)
-			}
-
-			var actRx, actTx uint64
-
-			if trackRx {
-				// TODO: handle wraparound
-				actRx = currRx - lastRx
-				lastRx = currRx
-			}
-
-			if trackTx {
-				actTx = currTx - lastTx
-				lastTx = currTx
-			}
-
-			select {
-			case statsChan <- rxTxStats{
-				rxBytes: actRx,
-				txBytes: actTx,
-				time:    n,
-			}:
-			default:
-				// log.Printf("dropping stats update")
-			}
-		}
-	}()
-
-	return nil
+	// The TUI is in real time, the other outputs don't have to wait
+	src.Realtime = showGraph
+
+	session := src.Session()
+	options.Window = session.Window
+	options.Accounting = session.Accounting
+	options.TrackRx = session.TrackRx
+	options.TrackTx = session.TrackTx
+	options.PacketSizes = session.PacketSizes
+	options.Incast = session.Incast
+
+	fmt.Fprintf(info, "replaying %s recorded on %s (kernel %s) at %s\n", path, session.Host, session.Kernel, session.Start.Format(time.RFC3339))
+	fmt.Fprintf(info, "%s window, %s timer, tracking %s (interfaces %s)\n", session.Window, session.Timer, session.Filters, strings.Join(session.Interfaces, ","))
+	return src, nil
 }
 
-func chooseCpuForPerfTimer() int {
-	if perfTimerCpu != -1 {
-		return perfTimerCpu
+// reloadFilters applies the filters from filter-file again, the result is
+// shown as an annotation
+func reloadFilters() {
+	spec, err := microburst.ReadFilterFile(filterFile, cmdlineFilters)
+	if err == nil {
+		_, err = collector.SetFilters(spec)
 	}
-
-	// We should choose a CPU that's not having too many irqs assigned
-	// to it.  Since cpu 0 is usually the busiest, we'll probably choose
-	// something from the end
-	//
-	// TODO: Properly choose a CPU by looking at the irq assignments,
-	// cpu topology etc
-
-	cpu := runtime.NumCPU() - 1
-	if cpu < 0 {
-		cpu = 0
+	if err != nil {
+		collector.Annotate(fmt.Sprintf("filter reload failed: %v", err))
 	}
-
-	return cpu
 }
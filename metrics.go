@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// The le bounds of the window bytes histograms, 1KiB to 64MiB by powers of
+// 2
+const (
+	METRICS_FIRST_BUCKET = 1024
+	METRICS_BUCKETS      = 17
+)
+
+// metricsDirection are the metrics of rx or tx
+type metricsDirection struct {
+	name      string
+	threshold uint64
+	buckets   [METRICS_BUCKETS]uint64
+	count     uint64
+	sum       uint64
+	bursts    uint64
+	// since the last scrape
+	scrapeHist *hdrhistogram.Histogram
+}
+
+func (d *metricsDirection) record(bytes uint64) {
+	for i := range d.buckets {
+		if bytes <= METRICS_FIRST_BUCKET<<i {
+			d.buckets[i]++
+		}
+	}
+	d.count++
+	d.sum += bytes
+	if bytes > d.threshold {
+		d.bursts++
+	}
+	d.scrapeHist.RecordValue(int64(bytes))
+}
+
+// metrics is a sink keeping the Prometheus metrics of the windows, served
+// in the text format by serveMetrics
+type metrics struct {
+	mu         sync.Mutex
+	iface      string
+	directions []*metricsDirection
+	lastTime   time.Time
+	timerHist  *hdrhistogram.Histogram
+	timerSum   time.Duration
+	// dropped is the number of windows dropped by the source, if it drops
+	// any
+	dropped func() uint64
+}
+
+func newMetrics(iface string, dropped func() uint64) *metrics {
+	if iface == "" {
+		iface = "all"
+	}
+	m := &metrics{
+		iface:     iface,
+		timerHist: hdrhistogram.New(1, int64(10_000_000_000), 3),
+		dropped:   dropped,
+	}
+	if options.TrackRx {
+		m.directions = append(m.directions, &metricsDirection{name: "rx", threshold: rxThreshold, scrapeHist: hdrhistogram.New(1, int64(10_000_000_000), 3)})
+	}
+	if options.TrackTx {
+		m.directions = append(m.directions, &metricsDirection{name: "tx", threshold: txThreshold, scrapeHist: hdrhistogram.New(1, int64(10_000_000_000), 3)})
+	}
+	return m
+}
+
+func (m *metrics) OnSample(s microburst.Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastTime.IsZero() {
+		m.timerHist.RecordValue(int64(s.Time.Sub(m.lastTime)))
+		m.timerSum += s.Time.Sub(m.lastTime)
+	}
+	m.lastTime = s.Time
+
+	for _, d := range m.directions {
+		if d.name == "rx" {
+			d.record(s.RxBytes)
+		} else {
+			d.record(s.TxBytes)
+		}
+	}
+}
+
+func (m *metrics) OnAnnotation(a microburst.Annotation) {
+}
+
+func (m *metrics) Close() error {
+	return nil
+}
+
+// write writes the metrics in the Prometheus text format. The max and p99
+// gauges are of the windows since the last scrape, and are reset.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP network_microburst_window_bytes Bytes in each burst window.\n")
+	fmt.Fprintf(w, "# TYPE network_microburst_window_bytes histogram\n")
+	for _, d := range m.directions {
+		labels := fmt.Sprintf("interface=%q,direction=%q", m.iface, d.name)
+		for i, n := range d.buckets {
+			fmt.Fprintf(w, "network_microburst_window_bytes_bucket{%s,le=\"%d\"} %d\n", labels, METRICS_FIRST_BUCKET<<i, n)
+		}
+		fmt.Fprintf(w, "network_microburst_window_bytes_bucket{%s,le=\"+Inf\"} %d\n", labels, d.count)
+		fmt.Fprintf(w, "network_microburst_window_bytes_sum{%s} %d\n", labels, d.sum)
+		fmt.Fprintf(w, "network_microburst_window_bytes_count{%s} %d\n", labels, d.count)
+	}
+
+	fmt.Fprintf(w, "# HELP network_microburst_window_bytes_max Bytes of the largest window since the last scrape.\n")
+	fmt.Fprintf(w, "# TYPE network_microburst_window_bytes_max gauge\n")
+	for _, d := range m.directions {
+		if d.scrapeHist.TotalCount() > 0 {
+			fmt.Fprintf(w, "network_microburst_window_bytes_max{interface=%q,direction=%q} %d\n", m.iface, d.name, d.scrapeHist.Max())
+		}
+	}
+	fmt.Fprintf(w, "# HELP network_microburst_window_bytes_p99 99th percentile of the window bytes since the last scrape.\n")
+	fmt.Fprintf(w, "# TYPE network_microburst_window_bytes_p99 gauge\n")
+	for _, d := range m.directions {
+		if d.scrapeHist.TotalCount() > 0 {
+			fmt.Fprintf(w, "network_microburst_window_bytes_p99{interface=%q,direction=%q} %d\n", m.iface, d.name, d.scrapeHist.ValueAtQuantile(99))
+		}
+		d.scrapeHist.Reset()
+	}
+
+	fmt.Fprintf(w, "# HELP network_microburst_burst_windows_total Windows with more bytes than the print threshold.\n")
+	fmt.Fprintf(w, "# TYPE network_microburst_burst_windows_total counter\n")
+	for _, d := range m.directions {
+		fmt.Fprintf(w, "network_microburst_burst_windows_total{interface=%q,direction=%q} %d\n", m.iface, d.name, d.bursts)
+	}
+
+	fmt.Fprintf(w, "# HELP network_microburst_timer_interval_seconds Measured time between the windows.\n")
+	fmt.Fprintf(w, "# TYPE network_microburst_timer_interval_seconds summary\n")
+	for _, q := range []float64{0.5, 0.99, 1} {
+		fmt.Fprintf(w, "network_microburst_timer_interval_seconds{interface=%q,quantile=\"%g\"} %g\n", m.iface, q, time.Duration(m.timerHist.ValueAtQuantile(q*100)).Seconds())
+	}
+	fmt.Fprintf(w, "network_microburst_timer_interval_seconds_sum{interface=%q} %g\n", m.iface, m.timerSum.Seconds())
+	fmt.Fprintf(w, "network_microburst_timer_interval_seconds_count{interface=%q} %d\n", m.iface, m.timerHist.TotalCount())
+
+	if m.dropped != nil {
+		fmt.Fprintf(w, "# HELP network_microburst_dropped_windows_total Windows dropped because the outputs couldn't keep up.\n")
+		fmt.Fprintf(w, "# TYPE network_microburst_dropped_windows_total counter\n")
+		fmt.Fprintf(w, "network_microburst_dropped_windows_total{interface=%q} %d\n", m.iface, m.dropped())
+	}
+}
+
+// ServeHTTP serves the metrics
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	m.write(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// serveMetrics serves the metrics on /metrics at addr, like :9100
+func serveMetrics(addr string, m *metrics) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(info, "metrics server: %v\n", err)
+		}
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics("eth0", func() uint64 { return 3 })
+	m.directions[0].threshold = 100_000
+
+	runSynthetic(t, `
+500/1 0
+1500000/1000 64/1 x2
+`, m)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	require.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+
+	for _, line := range []string{
+		`network_microburst_window_bytes_bucket{interface="eth0",direction="rx",le="1024"} 1`,
+		`network_microburst_window_bytes_bucket{interface="eth0",direction="rx",le="1048576"} 1`,
+		`network_microburst_window_bytes_bucket{interface="eth0",direction="rx",le="2097152"} 3`,
+		`network_microburst_window_bytes_bucket{interface="eth0",direction="rx",le="+Inf"} 3`,
+		`network_microburst_window_bytes_sum{interface="eth0",direction="rx"} 3000500`,
+		`network_microburst_window_bytes_count{interface="eth0",direction="tx"} 3`,
+		`network_microburst_burst_windows_total{interface="eth0",direction="rx"} 2`,
+		`network_microburst_burst_windows_total{interface="eth0",direction="tx"} 2`,
+		`network_microburst_timer_interval_seconds_count{interface="eth0"} 2`,
+		`network_microburst_dropped_windows_total{interface="eth0"} 3`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+	// the hdr histograms are 3 digits precise
+	require.Contains(t, body, `network_microburst_window_bytes_max{interface="eth0",direction="rx"} 150`)
+	require.Contains(t, body, `network_microburst_timer_interval_seconds{interface="eth0",quantile="0.5"} 0.00100`)
+
+	// the max and p99 are reset on each scrape
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.False(t, strings.Contains(rec.Body.String(), "network_microburst_window_bytes_max{"))
+}
@@ -4,96 +4,1593 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 #include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
 
 #ifndef IFNAMSIZ
 #define IFNAMSIZ 16
 #endif
 
+#ifndef CLOCK_MONOTONIC
+#define CLOCK_MONOTONIC 1
+#endif
+
+#ifndef ARPHRD_ETHER
+#define ARPHRD_ETHER 1
+#endif
+
+#define ETH_HLEN 14
+#define ETH_ALEN 6
+#define ETH_P_IP 0x0800
+#define ETH_P_IPV6 0x86DD
+#define TC_ACT_OK 0
+
+/* skb->pkt_type, from include/uapi/linux/if_packet.h */
+#define PACKET_HOST 0
+#define PACKET_BROADCAST 1
+#define PACKET_MULTICAST 2
+#define PACKET_OTHERHOST 3
+
+#define MAX_GROUPS 8
+#define NR_SIZE_BUCKETS 11
+/* the size buckets, then the GSO/GRO packets (of any size) */
+#define NR_SIZE_COUNTERS (NR_SIZE_BUCKETS + 1)
+
+/*
+    keys of txrx_info, also the order of the values published to userspace
+*/
+enum counter {
+    RX_BYTES = 0,
+    TX_BYTES,
+    RX_PACKETS,
+    TX_PACKETS,
+    /* rx bytes by skb->pkt_type, in the order of PACKET_* */
+    RX_HOST_BYTES,
+    RX_BROADCAST_BYTES,
+    RX_MULTICAST_BYTES,
+    RX_OTHERHOST_BYTES,
+    /* rx bytes delivered locally/forwarded, when the ip probes are loaded */
+    RX_LOCAL_BYTES,
+    RX_FORWARDED_BYTES,
+    /* rx/tx bytes of the groups, MAX_GROUPS each */
+    GROUP_RX_BYTES,
+    GROUP_TX_BYTES = GROUP_RX_BYTES + MAX_GROUPS,
+    /* rx/tx packets by the log2 of their size, and the GSO/GRO ones,
+       NR_SIZE_COUNTERS each */
+    RX_SIZE_PACKETS = GROUP_TX_BYTES + MAX_GROUPS,
+    TX_SIZE_PACKETS = RX_SIZE_PACKETS + NR_SIZE_COUNTERS,
+    /* bits set in the incast bitmaps, i.e., distinct rx sources/flows */
+    RX_SOURCES = TX_SIZE_PACKETS + NR_SIZE_COUNTERS,
+    RX_FLOWS,
+    NR_COUNTERS,
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, NR_COUNTERS);
+    __type(key, __u32);
+    __type(value, __u64);
+} txrx_info SEC(".maps");
+
+union name_buf {
+    char name[IFNAMSIZ];
+    struct {
+        u64 hi;
+        u64 lo;
+    }name_int;
+};
+
+/*
+    runtime changeable filters, set by userspace. A single entry, updated as
+    a whole.
+*/
+struct filter_config {
+    __u8 filter_dev;
+    __u8 filter_pkt;
+    __u8 filter_slot; /* half of filter_prog holding the active program */
+    __u8 filter_src_cidr;
+    __u8 filter_dst_cidr;
+    __u8 filter_port;
+    __u8 filter_mark;
+    __u8 pad;
+    union name_buf ifname;
+    __u32 mark; /* skb->mark & mark_mask must be mark */
+    __u32 mark_mask;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct filter_config);
+} filter_config SEC(".maps");
+
+static inline struct filter_config *get_filter_config()
+{
+    __u32 key = 0;
+    return bpf_map_lookup_elem(&filter_config, &key);
+}
+
+/*
+    checks if any of the packet filters (other than the device) is set, i.e.,
+    if the packet needs to be parsed
+*/
+static inline int filter_active(struct filter_config *cfg)
+{
+    return cfg->filter_pkt || cfg->filter_src_cidr || cfg->filter_dst_cidr || cfg->filter_port;
+}
+
+/*
+    checks the mark filter. The received packets are not marked yet where
+    they are accounted (before netfilter PREROUTING, policy routing etc.),
+    so the mark filter applies only to the transmitted ones (and the
+    local/forwarded classes).
+*/
+static inline int mark_allowed(struct filter_config *cfg, __u32 mark, int marked)
+{
+    return !cfg->filter_mark || !marked || (mark & cfg->mark_mask) == cfg->mark;
+}
+
+const volatile __u32 nr_cpus = 0;
+const volatile __u64 timer_interval_ns = 0;
+// account GSO packets as the segments that go on the wire, i.e., count
+// each segment as a packet and add the headers replicated in each segment.
+// wire accounting always does this.
+const volatile u8 gso_segments = 0;
+
+static __u64 get_metric(__u32 key);
+
+/*
+    finds the network header of the sk_buff
+    params:
+        skb: pointer to the sk_buff
+        l2_hdr_len: set to the link layer header length, 0 if unknown
+    returns:
+        offset of the network header from skb->head
+*/
+static inline __u32 skb_network_off(struct sk_buff *skb, __u32 *l2_hdr_len)
+{
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    unsigned char *data = BPF_CORE_READ(skb, data);
+    __u16 mac_header = BPF_CORE_READ(skb, mac_header);
+    __u16 network_header = BPF_CORE_READ(skb, network_header);
+    __u32 data_off = data - head;
+
+    *l2_hdr_len = 0;
+
+    // On transmit skb->data points to the link layer header, on receive it
+    // has already been pulled and points to the network header
+    if (mac_header != (__u16)~0U) {
+        if (data_off == mac_header) {
+            *l2_hdr_len = network_header - mac_header;
+            return network_header;
+        } else if (data_off > mac_header) {
+            *l2_hdr_len = data_off - mac_header;
+        }
+    }
+
+    return data_off;
+}
+
+#ifndef IPPROTO_ICMPV6
+#define IPPROTO_ICMPV6 58
+#endif
+
+/*
+    packet filter (like "tcp port 443 and host 10.0.0.5"), compiled by
+    userspace into a postfix program of filter_insn. Each predicate pushes
+    its result to a stack of booleans (bits of a u64), and/or/not operate on
+    the top of the stack.
+
+    filter_prog holds two programs, userspace writes the new one to the
+    inactive half and then switches filter_config.filter_slot, so we never
+    run a partially written program.
+*/
+#define MAX_FILTER_INSNS 32
+
+enum filter_op {
+    FILTER_END = 0,
+    FILTER_AND,
+    FILTER_OR,
+    FILTER_NOT,
+    FILTER_FAMILY,   /* arg: 4 or 6 */
+    FILTER_PROTO,    /* arg: IPPROTO_* */
+    FILTER_SRC_NET,  /* arg: 4 or 6, addr/mask */
+    FILTER_DST_NET,
+    FILTER_SRC_PORT, /* port_lo..port_hi */
+    FILTER_DST_PORT,
+    FILTER_DSCP,     /* arg: dscp */
+    FILTER_PRIORITY, /* addr: priority (u32, host order) */
+    FILTER_MARK,     /* addr/mask: skb->mark (u32, host order) */
+    FILTER_ENCAP,    /* arg: enum encap_type */
+    FILTER_VNI,      /* addr: vni (u32, host order) */
+};
+
+struct filter_insn {
+    __u8 op;
+    __u8 arg;
+    __u16 port_lo;
+    __u16 port_hi;
+    __u16 pad;
+    __u8 addr[16];
+    __u8 mask[16];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2 * MAX_FILTER_INSNS);
+    __type(key, __u32);
+    __type(value, struct filter_insn);
+} filter_prog SEC(".maps");
+
+struct pkt_info {
+    __u8 family; /* 4 or 6, 0 if not IP */
+    __u8 l4_proto;
+    __u8 has_ports;
+    __u8 dscp;
+    __u16 sport;
+    __u16 dport;
+    __u32 priority; /* skb->priority, i.e., the tc classid if set */
+    __u32 mark;     /* skb->mark */
+    __u8 encap;     /* enum encap_type, with decap */
+    __u32 vni;      /* VXLAN/Geneve VNI or GRE key */
+    __u8 saddr[16];
+    __u8 daddr[16];
+};
+
+/*
+    with decap, the packets tunneled with these are accounted by the inner
+    headers, i.e., the filters and groups see the inner ones
+*/
+enum encap_type {
+    ENCAP_NONE = 0,
+    ENCAP_VXLAN,
+    ENCAP_GENEVE,
+    ENCAP_GRE,
+    ENCAP_IPIP, /* IPv4/IPv6 in IPv4/IPv6 */
+};
+
+#define VXLAN_PORT 4789
+#define GENEVE_PORT 6081
+#define ETH_P_TEB 0x6558 /* transparent ethernet bridging */
+#define GRE_CSUM 0x80
+#define GRE_KEY 0x20
+#define GRE_SEQ 0x10
+
+const volatile u8 decap = 0;
+
+/*
+    the headers are copied here before parsing, map values (unlike the
+    stack) can be accessed with variable offsets in older kernels too
+*/
+#define PKT_HDR_BUF_LEN 128
+
+struct pkt_buf {
+    __u8 data[PKT_HDR_BUF_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct pkt_buf);
+} pkt_scratch SEC(".maps");
+
+static inline struct pkt_buf *get_pkt_buf()
+{
+    __u32 key = 0;
+    return bpf_map_lookup_elem(&pkt_scratch, &key);
+}
+
+static inline __u8 pkt_byte(struct pkt_buf *b, __u32 off)
+{
+    return b->data[off & (PKT_HDR_BUF_LEN - 1)];
+}
+
+static inline void pkt_copy_addr(__u8 *addr, struct pkt_buf *b, __u32 off, __u32 n)
+{
+    int i;
+
+    __builtin_memset(addr, 0, 16);
+#pragma unroll
+    for (i = 0; i < 16; i++) {
+        if (i < n) {
+            addr[i] = pkt_byte(b, off + i);
+        }
+    }
+}
+
+/*
+    parses the IPv4/IPv6 header and the tcp/udp/sctp ports
+    params:
+        b: headers
+        off: offset of the network header in b
+        len: valid bytes in b
+        eth_proto: ethernet protocol (network byte order)
+        info: parsed fields, left as is if not IP
+    returns:
+        offset of the transport header, 0 if not IP or not the first
+        fragment
+*/
+static inline __u32 parse_l3(struct pkt_buf *b, __u32 off, __u32 len, __u16 eth_proto, struct pkt_info *info)
+{
+    __u32 l4_off;
+    __u16 frag = 0;
+
+    if (off >= PKT_HDR_BUF_LEN) {
+        return 0;
+    }
+
+    if (eth_proto == bpf_htons(ETH_P_IP) && off + sizeof(struct iphdr) <= len) {
+        info->family = 4;
+        info->dscp = pkt_byte(b, off + 1) >> 2;
+        info->l4_proto = pkt_byte(b, off + offsetof(struct iphdr, protocol));
+        pkt_copy_addr(info->saddr, b, off + offsetof(struct iphdr, saddr), 4);
+        pkt_copy_addr(info->daddr, b, off + offsetof(struct iphdr, daddr), 4);
+        frag = ((pkt_byte(b, off + 6) & 0x1f) << 8) | pkt_byte(b, off + 7);
+        l4_off = off + (pkt_byte(b, off) & 0xf) * 4;
+    } else if (eth_proto == bpf_htons(ETH_P_IPV6) && off + sizeof(struct ipv6hdr) <= len) {
+        info->family = 6;
+        info->dscp = ((pkt_byte(b, off) & 0xf) << 2) | (pkt_byte(b, off + 1) >> 6);
+        info->l4_proto = pkt_byte(b, off + offsetof(struct ipv6hdr, nexthdr));
+        pkt_copy_addr(info->saddr, b, off + offsetof(struct ipv6hdr, saddr), 16);
+        pkt_copy_addr(info->daddr, b, off + offsetof(struct ipv6hdr, daddr), 16);
+        l4_off = off + sizeof(struct ipv6hdr);
+    } else {
+        return 0;
+    }
+
+    info->has_ports = 0;
+    info->sport = 0;
+    info->dport = 0;
+
+    // Only the first fragment has the transport header
+    if (frag != 0) {
+        return 0;
+    }
+
+    if (info->l4_proto != IPPROTO_TCP && info->l4_proto != IPPROTO_UDP && info->l4_proto != IPPROTO_SCTP) {
+        return l4_off;
+    }
+    if (l4_off + 4 > len || l4_off > PKT_HDR_BUF_LEN - 4) {
+        return l4_off;
+    }
+
+    info->sport = (pkt_byte(b, l4_off) << 8) | pkt_byte(b, l4_off + 1);
+    info->dport = (pkt_byte(b, l4_off + 2) << 8) | pkt_byte(b, l4_off + 3);
+    info->has_ports = 1;
+    return l4_off;
+}
+
+/*
+    finds the inner headers of a VXLAN, Geneve, GRE or IPIP packet
+    params:
+        b: headers
+        off: offset of the outer transport header in b
+        len: valid bytes in b
+        info: outer packet, encap and vni are set if encapsulated
+        inner_proto: set to the ethernet protocol of the inner packet
+    returns:
+        offset of the inner network header, 0 if not encapsulated
+*/
+static inline __u32 parse_encap(struct pkt_buf *b, __u32 off, __u32 len, struct pkt_info *info, __u16 *inner_proto)
+{
+    __u32 inner;
+    __u16 proto;
+    __u8 flags;
+
+    switch (info->l4_proto) {
+    case IPPROTO_UDP:
+        if (!info->has_ports) {
+            return 0;
+        }
+        // the headers need to be in the captured bytes, a short packet
+        // would read the stale bytes of the previous one
+        if (info->dport == VXLAN_PORT) {
+            // udp header, flags (1), reserved (3), vni (3), reserved (1)
+            if (off + 16 > len) {
+                return 0;
+            }
+            info->encap = ENCAP_VXLAN;
+            info->vni = (pkt_byte(b, off + 12) << 16) | (pkt_byte(b, off + 13) << 8) | pkt_byte(b, off + 14);
+            inner = off + 16 + ETH_HLEN;
+            proto = (pkt_byte(b, inner - 2) << 8) | pkt_byte(b, inner - 1);
+        } else if (info->dport == GENEVE_PORT) {
+            // udp header, version and options length (1), flags (1),
+            // protocol (2), vni (3), reserved (1), options
+            if (off + 16 > len) {
+                return 0;
+            }
+            inner = off + 16 + (pkt_byte(b, off + 8) & 0x3f) * 4;
+            if (inner > len) {
+                return 0;
+            }
+            info->encap = ENCAP_GENEVE;
+            info->vni = (pkt_byte(b, off + 12) << 16) | (pkt_byte(b, off + 13) << 8) | pkt_byte(b, off + 14);
+            proto = (pkt_byte(b, off + 10) << 8) | pkt_byte(b, off + 11);
+            if (proto == ETH_P_TEB) {
+                inner += ETH_HLEN;
+                proto = (pkt_byte(b, inner - 2) << 8) | pkt_byte(b, inner - 1);
+            }
+        } else {
+            return 0;
+        }
+        break;
+    case IPPROTO_GRE:
+        // flags (2), protocol (2), then the optional checksum, key and
+        // sequence number (4 each)
+        if (off + 4 > len) {
+            return 0;
+        }
+        info->encap = ENCAP_GRE;
+        flags = pkt_byte(b, off);
+        proto = (pkt_byte(b, off + 2) << 8) | pkt_byte(b, off + 3);
+        inner = off + 4;
+        if (flags & GRE_CSUM) {
+            inner += 4;
+        }
+        if ((flags & GRE_KEY) && inner + 4 <= len) {
+            info->vni = (pkt_byte(b, inner) << 24) | (pkt_byte(b, inner + 1) << 16) |
+                        (pkt_byte(b, inner + 2) << 8) | pkt_byte(b, inner + 3);
+            inner += 4;
+        }
+        if (flags & GRE_SEQ) {
+            inner += 4;
+        }
+        if (proto == ETH_P_TEB) {
+            inner += ETH_HLEN;
+            proto = (pkt_byte(b, inner - 2) << 8) | pkt_byte(b, inner - 1);
+        }
+        break;
+    case IPPROTO_IPIP:
+        info->encap = ENCAP_IPIP;
+        inner = off;
+        proto = ETH_P_IP;
+        break;
+    case IPPROTO_IPV6:
+        info->encap = ENCAP_IPIP;
+        inner = off;
+        proto = ETH_P_IPV6;
+        break;
+    default:
+        return 0;
+    }
+
+    if (inner >= len) {
+        return 0;
+    }
+    *inner_proto = bpf_htons(proto);
+    return inner;
+}
+
+/*
+    parses the IPv4/IPv6 and tcp/udp/sctp headers, with decap the ones of
+    the encapsulated packet
+    params:
+        b: headers, starting at the network header
+        len: valid bytes in b
+        eth_proto: ethernet protocol (network byte order)
+        info: parsed fields
+*/
+static inline void parse_pkt(struct pkt_buf *b, __u32 len, __u16 eth_proto, struct pkt_info *info)
+{
+    __u16 inner_proto = 0;
+    __u32 off = parse_l3(b, 0, len, eth_proto, info);
+
+    if (!decap || !off) {
+        return;
+    }
+
+    off = parse_encap(b, off, len, info, &inner_proto);
+    if (!off) {
+        return;
+    }
+
+    // Outer headers are kept if the inner ones are not in the buffer
+    parse_l3(b, off, len, inner_proto, info);
+}
+
+static inline int net_match(const __u8 *addr, const struct filter_insn *insn)
+{
+    int i;
+
+    for (i = 0; i < 16; i++) {
+        if ((addr[i] & insn->mask[i]) != insn->addr[i]) {
+            return 0;
+        }
+    }
+
+    return 1;
+}
+
+/*
+    runs the filter program on the packet
+    params:
+        info: parsed packet
+        slot: half of filter_prog to run
+    returns:
+        1: packet matches
+        0: no match
+*/
+static inline int filter_match(struct pkt_info *info, __u8 slot)
+{
+    __u64 stack = 0;
+    __u64 v;
+    int i;
+
+    for (i = 0; i < MAX_FILTER_INSNS; i++) {
+        __u32 key = (slot & 1) * MAX_FILTER_INSNS + i;
+        struct filter_insn *insn = bpf_map_lookup_elem(&filter_prog, &key);
+        if (!insn || insn->op == FILTER_END) {
+            break;
+        }
+
+        switch (insn->op) {
+        case FILTER_AND:
+            v = stack & (stack >> 1) & 1;
+            stack = ((stack >> 2) << 1) | v;
+            continue;
+        case FILTER_OR:
+            v = (stack | (stack >> 1)) & 1;
+            stack = ((stack >> 2) << 1) | v;
+            continue;
+        case FILTER_NOT:
+            stack ^= 1;
+            continue;
+        case FILTER_FAMILY:
+            v = info->family == insn->arg;
+            break;
+        case FILTER_PROTO:
+            v = info->family != 0 && info->l4_proto == insn->arg;
+            break;
+        case FILTER_SRC_NET:
+            v = info->family == insn->arg && net_match(info->saddr, insn);
+            break;
+        case FILTER_DST_NET:
+            v = info->family == insn->arg && net_match(info->daddr, insn);
+            break;
+        case FILTER_SRC_PORT:
+            v = info->has_ports && info->sport >= insn->port_lo && info->sport <= insn->port_hi;
+            break;
+        case FILTER_DST_PORT:
+            v = info->has_ports && info->dport >= insn->port_lo && info->dport <= insn->port_hi;
+            break;
+        case FILTER_DSCP:
+            v = info->family != 0 && info->dscp == insn->arg;
+            break;
+        case FILTER_PRIORITY:
+            v = info->priority == *(__u32 *)insn->addr;
+            break;
+        case FILTER_MARK:
+            v = (info->mark & *(__u32 *)insn->mask) == *(__u32 *)insn->addr;
+            break;
+        case FILTER_ENCAP:
+            v = info->encap == insn->arg;
+            break;
+        case FILTER_VNI:
+            v = info->encap != ENCAP_NONE && info->vni == *(__u32 *)insn->addr;
+            break;
+        default:
+            v = 0;
+        }
+
+        stack = (stack << 1) | v;
+    }
+
+    return stack & 1;
+}
+
+/*
+    src/dst cidr filters, IPv4 addresses are stored as IPv4-mapped IPv6
+    addresses (::ffff:a.b.c.d) so that a single trie handles both
+*/
+#define MAX_FILTER_CIDRS 1024
+
+struct cidr_key {
+    __u32 prefixlen;
+    __u8 addr[16];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, MAX_FILTER_CIDRS);
+    __type(key, struct cidr_key);
+    __type(value, __u8);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} src_cidrs SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, MAX_FILTER_CIDRS);
+    __type(key, struct cidr_key);
+    __type(value, __u8);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} dst_cidrs SEC(".maps");
+
+/*
+    port filter, indexed by the port, non zero means the port is tracked
+*/
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 65536);
+    __type(key, __u32);
+    __type(value, __u8);
+} filter_ports SEC(".maps");
+
+/*
+    looks up the address in the src or dst cidrs
+    params:
+        info: parsed packet
+        dst: 1 to look up the destination address in dst_cidrs, 0 for the
+             source address in src_cidrs
+    returns:
+        1: address is in one of the cidrs
+        0: no match
+*/
+static inline int cidr_match(struct pkt_info *info, int dst)
+{
+    struct cidr_key key = {.prefixlen = 128};
+    __u8 *addr = dst ? info->daddr : info->saddr;
+
+    if (info->family == 4) {
+        key.addr[10] = 0xff;
+        key.addr[11] = 0xff;
+        __builtin_memcpy(&key.addr[12], addr, 4);
+    } else if (info->family == 6) {
+        __builtin_memcpy(key.addr, addr, 16);
+    } else {
+        return 0;
+    }
+
+    if (dst) {
+        return bpf_map_lookup_elem(&dst_cidrs, &key) != NULL;
+    }
+    return bpf_map_lookup_elem(&src_cidrs, &key) != NULL;
+}
+
+static inline int port_match(__u16 port)
+{
+    __u32 key = port;
+    __u8 *v = bpf_map_lookup_elem(&filter_ports, &key);
+
+    return v && *v;
+}
+
+/*
+    checks the packet against the cidr, port and expression filters
+    returns:
+        1: allow processing
+        0: discard
+*/
+static inline int pkt_allowed(struct pkt_info *info, struct filter_config *cfg)
+{
+    if (cfg->filter_src_cidr && !cidr_match(info, 0)) {
+        return 0;
+    }
+
+    if (cfg->filter_dst_cidr && !cidr_match(info, 1)) {
+        return 0;
+    }
+
+    if (cfg->filter_port && !(info->has_ports && (port_match(info->sport) || port_match(info->dport)))) {
+        return 0;
+    }
+
+    if (cfg->filter_pkt && !filter_match(info, cfg->filter_slot)) {
+        return 0;
+    }
+
+    return 1;
+}
+
+/*
+    per group (like a DSCP value) counters, the groups to track are set by
+    userspace in group_slots, each gets one of the MAX_GROUPS rx and tx
+    counters
+*/
+enum group_kind {
+    GROUP_DSCP = 0,
+    GROUP_PRIORITY,
+    GROUP_MARK,
+    GROUP_VNI,
+};
+
+struct group_key {
+    __u32 kind;
+    __u32 value;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_GROUPS);
+    __type(key, struct group_key);
+    __type(value, __u32);
+} group_slots SEC(".maps");
+
+// bitmask of 1 << enum group_kind, set by userspace
+const volatile __u32 group_kinds = 0;
+// the mark groups are by skb->mark & group_mark_mask
+const volatile __u32 group_mark_mask = 0xffffffff;
+// count the distinct rx sources and flows, set by userspace
+const volatile u8 track_incast = 0;
+
+/*
+    checks if the packets need to be parsed for the groups or the incast
+    detection, even without filters
+*/
+static inline int need_pkt_info()
+{
+    return group_kinds || track_incast;
+}
+
+/*
+    parses the headers of the sk_buff
+    params:
+        skb: pointer to the sk_buff
+        info: parsed fields, family is 0 if the headers could not be read
+*/
+static inline void skb_parse(struct sk_buff *skb, struct pkt_info *info)
+{
+    struct pkt_buf *b = get_pkt_buf();
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    unsigned char *data = BPF_CORE_READ(skb, data);
+    unsigned int len = BPF_CORE_READ(skb, len);
+    __u32 l2_hdr_len;
+    __u32 l3_off = skb_network_off(skb, &l2_hdr_len);
+    __u32 data_off = data - head;
+
+    info->priority = BPF_CORE_READ(skb, priority);
+    info->mark = BPF_CORE_READ(skb, mark);
+
+    if (!b) {
+        return;
+    }
+
+    // Headers may not be in the linear part, only the ip filters will not
+    // match then
+    if (bpf_probe_read_kernel(b->data, sizeof(b->data), head + l3_off)) {
+        return;
+    }
+
+    if (l3_off - data_off < len) {
+        len -= l3_off - data_off;
+    } else {
+        len = 0;
+    }
+    parse_pkt(b, len, BPF_CORE_READ(skb, protocol), info);
+}
+
+/*
+    checks if device name and mark match the filters
+    params:
+        skb: pointer to the sk_buff
+        cfg: current filters
+        marked: if the packet is past the netfilter hooks setting the mark
+    returns:
+        1: allow processing
+        0: discard
+*/
+static inline int allow_packet(struct sk_buff* skb, struct filter_config *cfg, int marked)
+{
+    if (!mark_allowed(cfg, BPF_CORE_READ(skb, mark), marked)) {
+        return 0;
+    }
+
+    if (cfg->filter_dev != 1) {
+        return 1;
+    }
+
+    union name_buf real_devname;
+    struct net_device *dev;
+    BPF_CORE_READ_INTO(&dev, skb, dev); /* skb->dev */
+    BPF_CORE_READ_INTO(&real_devname, dev, name); /* dev->name */
+
+    if(cfg->ifname.name_int.hi != real_devname.name_int.hi || cfg->ifname.name_int.lo != real_devname.name_int.lo){
+        return 0;
+    }
+
+    return 1;
+}
+
+/*
+    runs the device and packet filters on the sk_buff
+    params:
+        skb: pointer to the sk_buff
+        info: parsed packet, filled if the filters or the groups need it
+        marked: if the packet is past the netfilter hooks setting the mark
+    returns:
+        1: allow processing
+        0: discard
+*/
+static inline int allow_skb(struct sk_buff* skb, struct pkt_info *info, int marked)
+{
+    struct filter_config *cfg = get_filter_config();
+    int filter = cfg && filter_active(cfg);
+
+    if (cfg && !allow_packet(skb, cfg, marked)) {
+        return 0;
+    }
+
+    if (filter || need_pkt_info()) {
+        skb_parse(skb, info);
+    }
+
+    if (filter && !pkt_allowed(info, cfg)) {
+        return 0;
+    }
+
+    return 1;
+}
+
+static inline void add_metric(__u32 key, __u64 val)
+{
+    u64 *value = bpf_map_lookup_elem(&txrx_info, &key);
+    if (value) {
+        *value += val;
+    }
+}
+
+static inline void add_group_metric(__u32 kind, __u32 value, __u32 base_key, __u64 bytes)
+{
+    struct group_key key = {.kind = kind, .value = value};
+    __u32 *slot = bpf_map_lookup_elem(&group_slots, &key);
+
+    if (slot && *slot < MAX_GROUPS) {
+        add_metric(base_key + *slot, bytes);
+    }
+}
+
+/*
+    accounts the bytes to the groups of the packet
+    params:
+        info: parsed packet
+        base_key: GROUP_RX_BYTES or GROUP_TX_BYTES
+        bytes: bytes to account
+*/
+static inline void add_group_metrics(struct pkt_info *info, __u32 base_key, __u64 bytes)
+{
+    if ((group_kinds & (1 << GROUP_DSCP)) && info->family) {
+        add_group_metric(GROUP_DSCP, info->dscp, base_key, bytes);
+    }
+
+    if (group_kinds & (1 << GROUP_PRIORITY)) {
+        add_group_metric(GROUP_PRIORITY, info->priority, base_key, bytes);
+    }
+
+    // the received packets are not marked yet, see mark_allowed
+    if ((group_kinds & (1 << GROUP_MARK)) && base_key == GROUP_TX_BYTES) {
+        add_group_metric(GROUP_MARK, info->mark & group_mark_mask, base_key, bytes);
+    }
+
+    if ((group_kinds & (1 << GROUP_VNI)) && info->encap != ENCAP_NONE) {
+        add_group_metric(GROUP_VNI, info->vni, base_key, bytes);
+    }
+}
+
+/*
+    incast detection: the distinct sources and flows of the received packets
+    are counted with linear counting. Each one hashes to a bit of a bitmap,
+    and the bits set for the first time in the window are counted in
+    RX_SOURCES/RX_FLOWS, userspace estimates the distinct count from that.
+    The words of the bitmaps are tagged with the window (epoch) they were
+    set in, so they don't need to be cleared. The epoch is advanced where
+    the window is collected (emit_metrics, calc_local_metrics or the go
+    timer), so that the bitmaps are reset at the same boundaries as the
+    reported windows.
+*/
+#define INCAST_BITMAP_WORDS 64 /* 4096 bits */
+
+struct incast_window_info {
+    __u64 epoch;
+    /* when the epoch was last advanced by calc_local_metrics */
+    __u64 ts;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct incast_window_info);
+} incast_window SEC(".maps");
+
+/*
+    starts a new incast window, i.e., the bits set so far are stale
+*/
+static inline void next_incast_window(void)
+{
+    __u32 key = 0;
+    struct incast_window_info *w;
+
+    if (!track_incast) {
+        return;
+    }
+
+    w = bpf_map_lookup_elem(&incast_window, &key);
+    if (w) {
+        __sync_fetch_and_add(&w->epoch, 1);
+    }
+}
+
+struct incast_word {
+    __u64 epoch;
+    __u64 bits;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2 * INCAST_BITMAP_WORDS); /* sources, then flows */
+    __type(key, __u32);
+    __type(value, struct incast_word);
+} incast_bitmaps SEC(".maps");
+
+#define FNV_OFFSET_BASIS 2166136261U
+#define FNV_PRIME 16777619U
+
+static inline __u32 fnv1a(__u32 h, const __u8 *data, int len)
+{
+    int i;
+
+#pragma unroll
+    for (i = 0; i < len; i++) {
+        h = (h ^ data[i]) * FNV_PRIME;
+    }
+    return h;
+}
+
+/*
+    sets the bit of the hash in the bitmap, counting it if it was not set in
+    this epoch yet. The update is not atomic, a bit set by another cpu at
+    the same time may be lost or counted twice, which is fine for an
+    estimate.
+    params:
+        bitmap: 0 for the sources, 1 for the flows
+        hash: hash of the source/flow
+        epoch: current window
+        key: RX_SOURCES or RX_FLOWS
+*/
+static inline void incast_mark(__u32 bitmap, __u32 hash, __u64 epoch, __u32 key)
+{
+    __u32 idx = bitmap * INCAST_BITMAP_WORDS + ((hash >> 6) & (INCAST_BITMAP_WORDS - 1));
+    __u64 bit = 1ULL << (hash & 63);
+    struct incast_word *w = bpf_map_lookup_elem(&incast_bitmaps, &idx);
+
+    if (!w) {
+        return;
+    }
+
+    if (w->epoch != epoch) {
+        w->epoch = epoch;
+        w->bits = 0;
+    }
+
+    if (w->bits & bit) {
+        return;
+    }
+    w->bits |= bit;
+    add_metric(key, 1);
+}
+
+/*
+    counts the source and the flow of the received packet
+    params:
+        info: parsed packet
+*/
+static inline void add_incast_metrics(struct pkt_info *info)
+{
+    __u32 key = 0;
+    struct incast_window_info *w;
+    __u64 epoch;
+    __u32 h;
+
+    if (!track_incast || !info->family) {
+        return;
+    }
+
+    w = bpf_map_lookup_elem(&incast_window, &key);
+    if (!w) {
+        return;
+    }
+    epoch = w->epoch;
+
+    h = fnv1a(FNV_OFFSET_BASIS, info->saddr, sizeof(info->saddr));
+    // finalize, linear counting needs the low bits well mixed
+    incast_mark(0, (h ^ (h >> 16)) * 0x45d9f3b, epoch, RX_SOURCES);
+
+    h = fnv1a(h, info->daddr, sizeof(info->daddr));
+    h = fnv1a(h, &info->l4_proto, 1);
+    h = fnv1a(h, (__u8 *)&info->sport, 2);
+    h = fnv1a(h, (__u8 *)&info->dport, 2);
+    incast_mark(1, (h ^ (h >> 16)) * 0x45d9f3b, epoch, RX_FLOWS);
+}
+
+/*
+    what the accounted bytes include, set by userspace
+        skb: skb->len as seen by the hook, i.e., the network layer packet
+             on receive and plus the link layer header on transmit (tc and
+             xdp see the link layer header both ways)
+        l3: network layer packet (IP header onwards)
+        l2: ethernet frame, i.e., plus link layer header and FCS
+        wire: plus preamble, SFD, inter frame gap and padding to the minimum
+              frame size, i.e., what the link capacity is spent on
+    The ethernet overheads (FCS, preamble etc.) are added only on ethernet
+    devices, l2 and wire are the link layer frame on the others.
+*/
+enum accounting_mode {
+    ACCOUNTING_SKB = 0,
+    ACCOUNTING_L3,
+    ACCOUNTING_L2,
+    ACCOUNTING_WIRE,
+};
+
+const volatile u8 accounting = ACCOUNTING_SKB;
+
+#define ETH_FCS_LEN 4
+#define ETH_MIN_FRAME_LEN 64 /* including FCS */
+#define ETH_PREAMBLE_IFG_LEN 20 /* preamble + SFD (8) and inter frame gap (12) */
+
+/*
+    converts the network layer bytes to the configured accounting
+    params:
+        l3_bytes: network layer bytes of all the packets
+        packets: number of packets (segments)
+        l2_hdr_len: link layer header length of each packet
+        skb_l2_len: link layer header length included in skb->len
+        ether: if the device is an ethernet one
+    returns:
+        bytes to account
+*/
+static inline __u64 accounted_bytes(__u64 l3_bytes, __u64 packets, __u32 l2_hdr_len, __u32 skb_l2_len, int ether)
+{
+    __u64 frame_bytes;
+
+    if (accounting == ACCOUNTING_SKB) {
+        return l3_bytes + packets * skb_l2_len;
+    }
+    if (accounting == ACCOUNTING_L3) {
+        return l3_bytes;
+    }
+    if (!ether) {
+        return l3_bytes + packets * l2_hdr_len;
+    }
+
+    frame_bytes = l3_bytes + packets * (l2_hdr_len + ETH_FCS_LEN);
+    if (accounting == ACCOUNTING_L2) {
+        return frame_bytes;
+    }
+
+    // We don't know the individual segment sizes of a GSO packet, all but
+    // the last are full sized anyway
+    if (packets == 1 && frame_bytes < ETH_MIN_FRAME_LEN) {
+        frame_bytes = ETH_MIN_FRAME_LEN;
+    }
+
+    return frame_bytes + packets * ETH_PREAMBLE_IFG_LEN;
+}
+
+static inline int count_segments()
+{
+    return gso_segments || accounting == ACCOUNTING_WIRE;
+}
+
+/*
+    computes the bytes and packets of the sk_buff
+    params:
+        skb: pointer to the sk_buff
+        bytes: bytes as per the configured accounting, plus the replicated
+               headers if it is a GSO packet and segments are counted
+        packets: 1, or the number of segments if it is a GSO packet and
+                 segments are counted (gso_segments or wire accounting)
+        pkt_len: network layer length of the sk_buff, i.e., before GSO
+                 segmentation
+*/
+static inline void skb_size(struct sk_buff *skb, __u64 *bytes, __u64 *packets, __u64 *pkt_len)
+{
+    unsigned int len = BPF_CORE_READ(skb, len);
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    __u32 l2_hdr_len = 0;
+    __u32 l3_off = skb_network_off(skb, &l2_hdr_len);
+    __u64 l3_bytes = len;
+    __u32 skb_l2_len = 0;
+    int ether = BPF_CORE_READ(skb, dev, type) == ARPHRD_ETHER;
+
+    if (l3_off != BPF_CORE_READ(skb, data) - head) {
+        // skb->len includes the link layer header
+        if (l2_hdr_len <= len) {
+            l3_bytes = len - l2_hdr_len;
+            skb_l2_len = l2_hdr_len;
+        }
+    }
+
+    *packets = 1;
+    *pkt_len = l3_bytes;
+
+    if (count_segments()) {
+        sk_buff_data_t end = BPF_CORE_READ(skb, end);
+        struct skb_shared_info *shinfo = (struct skb_shared_info *)(head + end);
+        __u16 segs = BPF_CORE_READ(shinfo, gso_segs);
+
+        if (segs > 1) {
+            unsigned int gso_type = BPF_CORE_READ(shinfo, gso_type);
+            __u16 transport_header = BPF_CORE_READ(skb, transport_header);
+            __u32 l4_len = 0;
+
+            *packets = segs;
+
+            if (gso_type & (SKB_GSO_TCPV4 | SKB_GSO_TCPV6)) {
+                __u8 doff = 0;
+                bpf_probe_read_kernel(&doff, sizeof(doff), head + transport_header + 12);
+                l4_len = (doff >> 4) * 4;
+            } else if (gso_type & SKB_GSO_UDP_L4) {
+                l4_len = sizeof(struct udphdr);
+            }
+
+            // The network and transport headers are replicated in each
+            // segment
+            __u32 hdr_len = transport_header + l4_len - l3_off;
+            if (l4_len > 0 && hdr_len <= l3_bytes) {
+                l3_bytes += (segs - 1) * hdr_len;
+            }
+        }
+    }
+
+    *bytes = accounted_bytes(l3_bytes, *packets, l2_hdr_len, skb_l2_len, ether);
+}
+
+// track the packet size histogram, set by userspace
+const volatile u8 track_sizes = 0;
+
+/*
+    tells if the sk_buff is a GSO/GRO packet, i.e., it is larger than the
+    MTU and goes on the wire as several segments
+*/
+static inline int skb_gso(struct sk_buff *skb)
+{
+    unsigned char *head = BPF_CORE_READ(skb, head);
+    sk_buff_data_t end = BPF_CORE_READ(skb, end);
+    struct skb_shared_info *shinfo = (struct skb_shared_info *)(head + end);
+
+    return BPF_CORE_READ(shinfo, gso_size) != 0;
+}
+
+/*
+    counts the packet in its size bucket, by the log2 of the size: <128,
+    128-255, ..., 32K-64K, 64K+, and the GSO/GRO packets separately
+    params:
+        base_key: RX_SIZE_PACKETS or TX_SIZE_PACKETS
+        len: network layer length of the packet
+        gso: if it is a GSO/GRO packet
+*/
+static inline void add_size_metric(__u32 base_key, __u64 len, int gso)
+{
+    __u32 bucket = 0;
+    int i;
+
+    if (!track_sizes) {
+        return;
+    }
+
+    len >>= 7;
+#pragma unroll
+    for (i = 0; i < NR_SIZE_BUCKETS - 1; i++) {
+        if (len) {
+            bucket++;
+            len >>= 1;
+        }
+    }
+
+    add_metric(base_key + bucket, 1);
+    if (gso) {
+        add_metric(base_key + NR_SIZE_BUCKETS, 1);
+    }
+}
+
+/*
+    accounts the bytes to the counter of the packet type
+    params:
+        pkt_type: PACKET_HOST, PACKET_BROADCAST, PACKET_MULTICAST or
+                  PACKET_OTHERHOST, ignored otherwise
+        bytes: bytes to account
+*/
+static inline void add_pkt_type_metric(__u8 pkt_type, __u64 bytes)
+{
+    if (pkt_type <= PACKET_OTHERHOST) {
+        add_metric(RX_HOST_BYTES + pkt_type, bytes);
+    }
+}
+
+static inline void account_rx(struct sk_buff *skb)
+{
+    struct pkt_info info = {};
+    __u64 bytes, packets, pkt_len;
+
+    if(!allow_skb(skb, &info, 0)){
+        return;
+    }
+
+    skb_size(skb, &bytes, &packets, &pkt_len);
+    add_metric(RX_BYTES, bytes);
+    add_metric(RX_PACKETS, packets);
+    add_size_metric(RX_SIZE_PACKETS, pkt_len, track_sizes && skb_gso(skb));
+    add_pkt_type_metric(BPF_CORE_READ_BITFIELD_PROBED(skb, pkt_type), bytes);
+    add_group_metrics(&info, GROUP_RX_BYTES, bytes);
+    add_incast_metrics(&info);
+}
+
+static inline void account_tx(struct sk_buff *skb)
+{
+    struct pkt_info info = {};
+    __u64 bytes, packets, pkt_len;
+
+    if(!allow_skb(skb, &info, 1)){
+        return;
+    }
+
+    skb_size(skb, &bytes, &packets, &pkt_len);
+    add_metric(TX_BYTES, bytes);
+    add_metric(TX_PACKETS, packets);
+    add_size_metric(TX_SIZE_PACKETS, pkt_len, track_sizes && skb_gso(skb));
+    add_group_metrics(&info, GROUP_TX_BYTES, bytes);
+}
+
+SEC("tp_btf/netif_receive_skb")
+int BPF_PROG(trace_network_receive, struct sk_buff *skb)
+{
+    account_rx(skb);
+    return 0;
+}
+
+SEC("tp_btf/net_dev_start_xmit")
+int BPF_PROG(trace_network_transmit, struct sk_buff *skb)
+{
+    account_tx(skb);
+    return 0;
+}
+
+/*
+    raw tracepoint variants, for kernels where tp_btf is not available
+*/
+SEC("raw_tp/netif_receive_skb")
+int BPF_PROG(raw_trace_network_receive, struct sk_buff *skb)
+{
+    account_rx(skb);
+    return 0;
+}
+
+SEC("raw_tp/net_dev_start_xmit")
+int BPF_PROG(raw_trace_network_transmit, struct sk_buff *skb)
+{
+    account_tx(skb);
+    return 0;
+}
+
+/*
+    kprobe variants, for kernels where neither tp_btf nor raw tracepoints
+    are available
+*/
+
+// __netif_receive_skb_core() takes struct sk_buff ** since 5.7 (and the
+// stable kernels it was backported to), set by userspace
+const volatile u8 rx_kprobe_pskb = 0;
+
+// dev_hard_start_xmit() gets a list of skbs (linked by skb->next) when the
+// qdisc dequeues in bulk, we only walk up to this many of them
+#define MAX_XMIT_LIST 16
+
+SEC("kprobe/__netif_receive_skb_core")
+int BPF_KPROBE(kprobe_network_receive, void *arg0)
+{
+    struct sk_buff *skb = arg0;
+
+    if (rx_kprobe_pskb) {
+        if (bpf_probe_read_kernel(&skb, sizeof(skb), arg0)) {
+            return 0;
+        }
+    }
+
+    account_rx(skb);
+    return 0;
+}
+
+SEC("kprobe/dev_hard_start_xmit")
+int BPF_KPROBE(kprobe_network_transmit, struct sk_buff *first)
+{
+    struct sk_buff *skb = first;
+    int i;
+
+    for (i = 0; i < MAX_XMIT_LIST && skb; i++) {
+        account_tx(skb);
+        skb = BPF_CORE_READ(skb, next);
+    }
+
+    return 0;
+}
+
+/*
+    local delivery vs forwarding of the received packets, loaded only when
+    these classes are asked for. ip_local_deliver()/ip6_input() and
+    ip_forward()/ip6_forward() are where the routing result is acted upon.
+    With tc/xdp the device filter is not set (the programs are attached to
+    the interfaces instead), so these check the receiving device against
+    the attached interfaces, set by userspace.
+*/
+const volatile u8 filter_ifindex = 0;
+
 struct {
-    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
-    __uint(max_entries, 2);
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 64);
     __type(key, __u32);
-    __type(value, __u64);
-} txrx_info SEC(".maps");
+    __type(value, __u8);
+} attached_ifindexes SEC(".maps");
 
-union name_buf {
-    char name[IFNAMSIZ];
-    struct {
-        u64 hi;
-        u64 lo;
-    }name_int;
-};
+static inline void account_rx_class(struct sk_buff *skb, __u32 key)
+{
+    struct pkt_info info = {};
+    __u64 bytes, packets, pkt_len;
+    __u32 ifindex;
 
-const volatile u8 filter_dev = 0;
-const volatile union name_buf ifname;
-const volatile __u32 nr_cpus = 0;
+    if (filter_ifindex) {
+        ifindex = BPF_CORE_READ(skb, dev, ifindex);
+        if (!bpf_map_lookup_elem(&attached_ifindexes, &ifindex)) {
+            return;
+        }
+    }
+
+    // past PREROUTING, so the mark is set
+    if(!allow_skb(skb, &info, 1)){
+        return;
+    }
+
+    skb_size(skb, &bytes, &packets, &pkt_len);
+    add_metric(key, bytes);
+}
+
+SEC("kprobe/ip_local_deliver")
+int BPF_KPROBE(kprobe_ip_local_deliver, struct sk_buff *skb)
+{
+    account_rx_class(skb, RX_LOCAL_BYTES);
+    return 0;
+}
 
-static __u64 get_rx_metrics();
-static __u64 get_tx_metrics();
+SEC("kprobe/ip6_input")
+int BPF_KPROBE(kprobe_ip6_input, struct sk_buff *skb)
+{
+    account_rx_class(skb, RX_LOCAL_BYTES);
+    return 0;
+}
+
+SEC("kprobe/ip_forward")
+int BPF_KPROBE(kprobe_ip_forward, struct sk_buff *skb)
+{
+    account_rx_class(skb, RX_FORWARDED_BYTES);
+    return 0;
+}
+
+SEC("kprobe/ip6_forward")
+int BPF_KPROBE(kprobe_ip6_forward, struct sk_buff *skb)
+{
+    account_rx_class(skb, RX_FORWARDED_BYTES);
+    return 0;
+}
+
+/*
+    tc/xdp variants, attached to the selected interfaces only (so no
+    allow_packet here). The tracepoints see the packets after GRO on rx and
+    before GSO on tx, XDP sees the frames as received from the wire.
+*/
 
 /*
-    checks if device name matches the filter
+    computes the length of the headers replicated in each segment of a GSO
+    packet, from the link layer header up to the end of the tcp/udp header
     params:
-        skb: pointer to the sk_buff
+        skb: pointer to the __sk_buff
     returns:
-        1: allow processing
-        0: discard
+        header length, 0 if it is not tcp/udp over IPv4/IPv6
 */
-static inline int allow_packet(struct sk_buff* skb)
+static inline __u32 tc_hdr_len(struct __sk_buff *skb)
 {
-    if (filter_dev != 1) {
-        return 1;
-    }
+    __u32 off = ETH_HLEN;
+    __u8 l4_proto = 0;
+    __u8 b = 0;
 
-    union name_buf real_devname;
-    struct net_device *dev;
-    BPF_CORE_READ_INTO(&dev, skb, dev); /* skb->dev */
-    BPF_CORE_READ_INTO(&real_devname, dev, name); /* dev->name */
+    if (skb->protocol == bpf_htons(ETH_P_IP)) {
+        if (bpf_skb_load_bytes(skb, off, &b, 1))
+            return 0;
+        if (bpf_skb_load_bytes(skb, off + offsetof(struct iphdr, protocol), &l4_proto, 1))
+            return 0;
+        off += (b & 0xf) * 4;
+    } else if (skb->protocol == bpf_htons(ETH_P_IPV6)) {
+        if (bpf_skb_load_bytes(skb, off + offsetof(struct ipv6hdr, nexthdr), &l4_proto, 1))
+            return 0;
+        off += sizeof(struct ipv6hdr);
+    } else {
+        return 0;
+    }
 
-    if((ifname.name_int).hi != real_devname.name_int.hi || (ifname.name_int).lo != real_devname.name_int.lo){
+    if (l4_proto == IPPROTO_TCP) {
+        if (bpf_skb_load_bytes(skb, off + 12, &b, 1))
+            return 0;
+        off += (b >> 4) * 4;
+    } else if (l4_proto == IPPROTO_UDP) {
+        off += sizeof(struct udphdr);
+    } else {
         return 0;
     }
 
-    return 1;
+    return off;
 }
 
+/*
+    parses the headers of the __sk_buff
+    params:
+        skb: pointer to the __sk_buff
+        info: parsed fields, family is 0 if the headers could not be read
+*/
+static inline void tc_parse(struct __sk_buff *skb, struct pkt_info *info)
+{
+    struct pkt_buf *b = get_pkt_buf();
+    __u32 len;
 
-SEC("tp_btf/netif_receive_skb")
-int BPF_PROG(trace_network_receive, struct sk_buff *skb)
+    info->priority = skb->priority;
+    info->mark = skb->mark;
+
+    if (!b || skb->len <= ETH_HLEN) {
+        return;
+    }
+
+    len = skb->len - ETH_HLEN;
+    if (len > PKT_HDR_BUF_LEN) {
+        len = PKT_HDR_BUF_LEN;
+    }
+    if (bpf_skb_load_bytes(skb, ETH_HLEN, b->data, len)) {
+        return;
+    }
+
+    parse_pkt(b, len, skb->protocol, info);
+}
+
+static inline void tc_account(struct __sk_buff *skb, __u32 bytes_key, __u32 packets_key)
 {
-    if(!allow_packet(skb)){
-        return 0;
+    struct filter_config *cfg = get_filter_config();
+    int filter = cfg && filter_active(cfg);
+    struct pkt_info info = {};
+
+    if (cfg && !mark_allowed(cfg, skb->mark, bytes_key == TX_BYTES)) {
+        return;
     }
 
-    __u32 key = 0;
-    u64 *value = bpf_map_lookup_elem(&txrx_info, &key);
-    if (value) {
-        unsigned int len = 0;
-        BPF_CORE_READ_INTO(&len, skb, len); /* skb->len */
-        *value += len;
-        return 0;
+    if (filter || need_pkt_info()) {
+        tc_parse(skb, &info);
     }
 
-    return 0;
+    if (filter && !pkt_allowed(&info, cfg)) {
+        return;
+    }
+
+    // tc programs always see the link layer header
+    __u64 l3_bytes = skb->len > ETH_HLEN ? skb->len - ETH_HLEN : 0;
+    __u64 pkt_len = l3_bytes;
+    __u64 packets = 1;
+
+    if (count_segments() && skb->gso_segs > 1) {
+        __u32 hdr_len = tc_hdr_len(skb);
+
+        packets = skb->gso_segs;
+        if (hdr_len > ETH_HLEN) {
+            l3_bytes += (packets - 1) * (hdr_len - ETH_HLEN);
+        }
+    }
+
+    __u64 bytes = accounted_bytes(l3_bytes, packets, ETH_HLEN, ETH_HLEN, 1);
+    add_metric(bytes_key, bytes);
+    add_metric(packets_key, packets);
+    if (bytes_key == RX_BYTES) {
+        add_pkt_type_metric(skb->pkt_type, bytes);
+        add_group_metrics(&info, GROUP_RX_BYTES, bytes);
+        add_size_metric(RX_SIZE_PACKETS, pkt_len, skb->gso_segs > 1);
+        add_incast_metrics(&info);
+    } else {
+        add_group_metrics(&info, GROUP_TX_BYTES, bytes);
+        add_size_metric(TX_SIZE_PACKETS, pkt_len, skb->gso_segs > 1);
+    }
 }
 
-SEC("tp_btf/net_dev_start_xmit")
-int BPF_PROG(trace_network_transmit, struct sk_buff *skb)
+SEC("tc")
+int tc_network_receive(struct __sk_buff *skb)
 {
-    if(!allow_packet(skb)){
-        return 0;
+    tc_account(skb, RX_BYTES, RX_PACKETS);
+    return TC_ACT_OK;
+}
+
+SEC("tc")
+int tc_network_transmit(struct __sk_buff *skb)
+{
+    tc_account(skb, TX_BYTES, TX_PACKETS);
+    return TC_ACT_OK;
+}
+
+/*
+    parses the headers of the xdp frame, there is no skb->priority or
+    skb->mark yet
+    params:
+        ctx: xdp context
+        info: parsed fields, family is 0 if the headers could not be read
+*/
+static inline void xdp_parse(struct xdp_md *ctx, struct pkt_info *info)
+{
+    struct pkt_buf *b = get_pkt_buf();
+    void *data = (void *)(long)ctx->data;
+    void *data_end = (void *)(long)ctx->data_end;
+    struct ethhdr *eth = data;
+    __u8 *p;
+    __u32 i;
+
+    if (!b || (void *)(eth + 1) > data_end) {
+        return;
     }
 
-    __u32 key = 1;
-    u64 *value = bpf_map_lookup_elem(&txrx_info, &key);
-    if (value) {
-        unsigned int len = 0;
-        BPF_CORE_READ_INTO(&len, skb, len); /* skb->len */
-        *value += len;
-        return 0;
+    p = (void *)(eth + 1);
+    for (i = 0; i < PKT_HDR_BUF_LEN; i++) {
+        if ((void *)(p + i + 1) > data_end) {
+            break;
+        }
+        b->data[i] = p[i];
     }
 
-    return 0;
+    parse_pkt(b, i, eth->h_proto, info);
+}
+
+/*
+    XDP runs before eth_type_trans(), so there is no pkt_type yet. We can
+    tell broadcast and multicast from the destination address, but not
+    whether it is ours, everything else is counted as PACKET_HOST.
+*/
+static inline __u8 xdp_pkt_type(struct xdp_md *ctx)
+{
+    void *data = (void *)(long)ctx->data;
+    void *data_end = (void *)(long)ctx->data_end;
+    struct ethhdr *eth = data;
+    int i;
+
+    if ((void *)(eth + 1) > data_end) {
+        return PACKET_HOST;
+    }
+
+    if (!(eth->h_dest[0] & 1)) {
+        return PACKET_HOST;
+    }
+
+    for (i = 0; i < ETH_ALEN; i++) {
+        if (eth->h_dest[i] != 0xff) {
+            return PACKET_MULTICAST;
+        }
+    }
+
+    return PACKET_BROADCAST;
+}
+
+SEC("xdp")
+int xdp_network_receive(struct xdp_md *ctx)
+{
+    __u64 len = ctx->data_end - ctx->data;
+    struct filter_config *cfg = get_filter_config();
+    int filter = cfg && filter_active(cfg);
+    struct pkt_info info = {};
+
+    if (filter || need_pkt_info()) {
+        xdp_parse(ctx, &info);
+    }
+
+    if (filter && !pkt_allowed(&info, cfg)) {
+        return XDP_PASS;
+    }
+
+    __u64 bytes = accounted_bytes(len > ETH_HLEN ? len - ETH_HLEN : 0, 1, ETH_HLEN, ETH_HLEN, 1);
+    add_metric(RX_BYTES, bytes);
+    add_metric(RX_PACKETS, 1);
+    add_pkt_type_metric(xdp_pkt_type(ctx), bytes);
+    add_group_metrics(&info, GROUP_RX_BYTES, bytes);
+    add_size_metric(RX_SIZE_PACKETS, len > ETH_HLEN ? len - ETH_HLEN : 0, 0);
+    add_incast_metrics(&info);
+    return XDP_PASS;
 }
 
 struct {
@@ -103,13 +1600,11 @@ struct {
 
 struct xfer_metric {
     __u64 ts;
-    __u64 rx_bytes;
-    __u64 tx_bytes;
+    __u64 values[NR_COUNTERS];
 } xfer_metric;
 
 struct txrx_last_info {
-    __u64 rx_bytes;
-    __u64 tx_bytes;
+    __u64 values[NR_COUNTERS];
     __u64 ts;
 } txrx_last_info;
 
@@ -120,18 +1615,35 @@ struct {
     __type(value, struct txrx_last_info);
 } txrx_last SEC(".maps");
 
-SEC("perf_event")
-int calc_metrics(struct bpf_perf_event_data *ctx)
+/*
+    computes the bytes transferred since the last call and publishes it to
+    the events ringbuf. The counters are read straight into the reserved
+    event, NR_COUNTERS of them don't fit the bpf stack along with the
+    helpers locals.
+    params:
+        last: state from the previous call, updated in place
+    returns:
+        0: success
+        1: ringbuf is full, event dropped
+*/
+static inline int emit_metrics(struct txrx_last_info *last)
 {
-    __u32 key = 0;
     struct xfer_metric *event;
-    struct txrx_last_info *value;
-    __u64 curr_rx_bytes;
-    __u64 curr_tx_bytes;
-    __u64 curr_ts;
+    __u64 curr, curr_ts;
+    int i;
+
+    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    if (!event) {
+        next_incast_window();
+        return 1;
+    }
 
-    curr_rx_bytes = get_rx_metrics();
-    curr_tx_bytes = get_tx_metrics();
+    for (i = 0; i < NR_COUNTERS; i++) {
+        curr = get_metric(i);
+        event->values[i] = curr > 0 ? curr - last->values[i] : 0;
+        last->values[i] = curr;
+    }
+    next_incast_window();
     // We rely on the time for rate calcuation. It is possible that the
     // timer is triggered but scheduling/execution of this function is
     // delayed, so it is possbile that the next execution might happen
@@ -140,74 +1652,205 @@ int calc_metrics(struct bpf_perf_event_data *ctx)
     // cpu, higher priority etc.
     curr_ts = bpf_ktime_get_boot_ns();
 
+    // The first call only sets the baseline
+    if (last->ts == 0) {
+        last->ts = curr_ts;
+        bpf_ringbuf_discard(event, 0);
+        return 0;
+    }
+
+    event->ts = curr_ts;
+    last->ts = curr_ts;
+    bpf_ringbuf_submit(event, 0);
+
+    return 0;
+}
+
+SEC("perf_event")
+int calc_metrics(struct bpf_perf_event_data *ctx)
+{
+    __u32 key = 0;
+    struct txrx_last_info *value;
+
     value = bpf_map_lookup_elem(&txrx_last, &key);
     if (value) {
-        if (value->ts != 0) {
-            event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
-            if (!event)
-                return 1;
-            
-            if (curr_rx_bytes > 0) {
-                event->rx_bytes = curr_rx_bytes - value->rx_bytes;
-            } else {
-                event->rx_bytes = 0;
-            }
-            if (curr_tx_bytes > 0) {
-                event->tx_bytes = curr_tx_bytes - value->tx_bytes;
-            } else {
-                event->tx_bytes = 0;
-            }
-            event->ts = curr_ts;
+        return emit_metrics(value);
+    }
+
+    return 0;
+}
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 1024 * 1024);
+} cpu_events SEC(".maps");
 
-            bpf_ringbuf_submit(event, 0);
+struct xfer_metric_cpu {
+    __u64 ts;
+    __u32 cpu;
+    __u32 pad;
+    __u64 values[NR_COUNTERS];
+} xfer_metric_cpu;
+
+/*
+    advances the incast window from the per cpu timers, every cpu gets here
+    once per window and the first one advances it
+    params:
+        curr_ts: time of the timer
+*/
+static inline void next_local_incast_window(__u64 curr_ts)
+{
+    __u32 key = 0;
+    struct incast_window_info *incast;
+    __u64 ts;
+
+    incast = bpf_map_lookup_elem(&incast_window, &key);
+    if (track_incast && incast) {
+        ts = incast->ts;
+        if (curr_ts - ts >= timer_interval_ns / 2 &&
+            __sync_val_compare_and_swap(&incast->ts, ts, curr_ts) == ts) {
+            __sync_fetch_and_add(&incast->epoch, 1);
         }
+    }
+}
+
+/*
+    runs on every cpu and publishes the bytes transferred on the local cpu
+    only, userspace merges them into windows. This avoids reading the other
+    cpus counters (and bpf_map_lookup_percpu_elem). Same as emit_metrics,
+    the counters are read straight into the reserved event.
+*/
+SEC("perf_event")
+int calc_local_metrics(struct bpf_perf_event_data *ctx)
+{
+    __u32 key = 0;
+    struct xfer_metric_cpu *event;
+    struct txrx_last_info *last;
+    __u64 curr, curr_ts;
+    u64 *val;
+    int i;
+
+    last = bpf_map_lookup_elem(&txrx_last, &key);
+    if (!last) {
+        return 0;
+    }
 
-        value->rx_bytes = curr_rx_bytes;
-        value->tx_bytes = curr_tx_bytes;
-        value->ts = curr_ts;
+    event = bpf_ringbuf_reserve(&cpu_events, sizeof(*event), 0);
+    if (!event) {
+        next_local_incast_window(bpf_ktime_get_boot_ns());
+        return 1;
+    }
+
+    for (i = 0; i < NR_COUNTERS; i++) {
+        key = i;
+        val = bpf_map_lookup_elem(&txrx_info, &key);
+        curr = val ? *val : 0;
+        event->values[i] = curr - last->values[i];
+        last->values[i] = curr;
+    }
+    curr_ts = bpf_ktime_get_boot_ns();
+    next_local_incast_window(curr_ts);
 
+    // The first call only sets the baseline
+    if (last->ts == 0) {
+        last->ts = curr_ts;
+        bpf_ringbuf_discard(event, 0);
         return 0;
     }
 
+    event->ts = curr_ts;
+    event->cpu = bpf_get_smp_processor_id();
+    event->pad = 0;
+    last->ts = curr_ts;
+    bpf_ringbuf_submit(event, 0);
+
     return 0;
 }
 
-static __u64 get_rx_metrics() {
+/*
+    vmlinux.h only carries the kernel side struct bpf_timer_kern, so declare
+    the uapi one here
+*/
+struct bpf_timer {
+    __u64 __opaque[2];
+} __attribute__((aligned(8)));
 
-    __u64 bytes = 0;
-    #ifndef __USER_SPACE_ONLY_PERCPU_COMPUTE
-    int i = 0;
-    // TODO: maybe we should have per cpu perf timer event, and send those
-    // per cpu metrics to userspace and sum them over there? this way we can
-    // avoid the cross CPU access here
-    for (i=0; i<nr_cpus; i++) {
-        __u32 key = 0;
-        u64 *val = bpf_map_lookup_percpu_elem(&txrx_info, &key, i);
-        if (val != NULL)  {
-            bytes += *val;
-        }
+struct metrics_timer_info {
+    struct bpf_timer timer;
+    // The timer callback is not pinned to a cpu, so keep the last values
+    // along with the timer instead of in the per cpu txrx_last
+    struct txrx_last_info last;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct metrics_timer_info);
+} metrics_timer SEC(".maps");
+
+static int metrics_timer_cb(void *map, __u32 *key, struct metrics_timer_info *info)
+{
+    emit_metrics(&info->last);
+    bpf_timer_start(&info->timer, timer_interval_ns, 0);
+
+    return 0;
+}
+
+/*
+    arms the bpf timer, which then re-arms itself every timer_interval_ns.
+    run once from userspace via BPF_PROG_RUN
+*/
+SEC("syscall")
+int start_metrics_timer(void *ctx)
+{
+    __u32 key = 0;
+    struct metrics_timer_info *info;
+    long err;
+
+    info = bpf_map_lookup_elem(&metrics_timer, &key);
+    if (!info) {
+        return 1;
+    }
+
+    err = bpf_timer_init(&info->timer, &metrics_timer, CLOCK_MONOTONIC);
+    if (err) {
+        return 1;
+    }
+
+    err = bpf_timer_set_callback(&info->timer, metrics_timer_cb);
+    if (err) {
+        return 1;
     }
-    #endif
 
-    return bytes;
+    err = bpf_timer_start(&info->timer, timer_interval_ns, 0);
+    if (err) {
+        return 1;
+    }
 
+    return 0;
 }
 
-static __u64 get_tx_metrics() {
-    __u64 bytes = 0;
-    
+/*
+    sums the given counter across all the cpus
+*/
+static __u64 get_metric(__u32 key) {
+    __u64 total = 0;
+
     #ifndef __USER_SPACE_ONLY_PERCPU_COMPUTE
     int i = 0;
+    // NOTE: this reads other cpus counters without any synchronization,
+    // calc_local_metrics (timer=perf-percpu) avoids this by summing the per
+    // cpu metrics in userspace instead
     for (i=0; i<nr_cpus; i++) {
-        __u32 key = 1;
         u64 *val = bpf_map_lookup_percpu_elem(&txrx_info, &key, i);
         if (val != NULL)  {
-            bytes += *val;
+            total += *val;
         }
     }
     #endif
 
-    return bytes;
+    return total;
 }
 
 char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+const (
+	// OTLP_SCALE is the scale of the exponential histograms, the bucket
+	// bounds grow by 2^(2^-3), i.e., ~9%
+	OTLP_SCALE                  = 3
+	OTLP_TEMPORALITY_CUMULATIVE = 2
+)
+
+// otlpSeries is a histogram of the bytes per window and its attributes
+type otlpSeries struct {
+	attributes []otlpKeyValue
+	hist       *windowHist
+}
+
+// otlpExporter is a sink pushing the histograms of the window bytes to an
+// OpenTelemetry collector as OTLP/HTTP (JSON) exponential histograms, with
+// the same aggregation as the summary
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+	resource []otlpKeyValue
+	trackRx  bool
+	trackTx  bool
+	start    time.Time
+
+	mu       sync.Mutex
+	rx       otlpSeries
+	tx       otlpSeries
+	classes  []otlpSeries
+	failures int
+	lastErr  error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newOtlpExporter exports to endpoint every interval, the path defaults to
+// /v1/metrics
+func newOtlpExporter(endpoint string, interval time.Duration, session microburst.Session, classes []microburst.Class) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q, expected like http://localhost:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid otlp interval %s", interval)
+	}
+
+	e := &otlpExporter{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		resource: []otlpKeyValue{
+			otlpString("service.name", "network-microburst"),
+			otlpString("host.name", session.Host),
+			otlpString("os.type", "linux"),
+			otlpString("os.version", session.Kernel),
+			otlpString("network.interface.name", strings.Join(session.Interfaces, ",")),
+		},
+		trackRx: session.TrackRx,
+		trackTx: session.TrackTx,
+		start:   time.Now(),
+		rx:      otlpSeries{attributes: []otlpKeyValue{otlpString("direction", "rx")}, hist: newWindowHist()},
+		tx:      otlpSeries{attributes: []otlpKeyValue{otlpString("direction", "tx")}, hist: newWindowHist()},
+	}
+	for _, class := range classes {
+		e.classes = append(e.classes, otlpSeries{
+			attributes: []otlpKeyValue{otlpString("class", class.Name)},
+			hist:       newWindowHist(),
+		})
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := e.export(); err != nil {
+					e.mu.Lock()
+					e.failures++
+					e.lastErr = err
+					e.mu.Unlock()
+				}
+			case <-e.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return e, nil
+}
+
+func (e *otlpExporter) OnSample(s microburst.Sample) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.trackRx {
+		e.rx.hist.record(s.RxBytes)
+	}
+	if e.trackTx {
+		e.tx.hist.record(s.TxBytes)
+	}
+	for i, series := range e.classes {
+		series.hist.record(s.Classes[i])
+	}
+}
+
+func (e *otlpExporter) OnAnnotation(a microburst.Annotation) {
+}
+
+// Close exports the windows since the last export
+func (e *otlpExporter) Close() error {
+	e.cancel()
+	e.wg.Wait()
+
+	if err := e.export(); err != nil {
+		return err
+	}
+	if e.failures > 0 {
+		return fmt.Errorf("%d otlp exports failed, the last one: %w", e.failures, e.lastErr)
+	}
+	return nil
+}
+
+// export posts the histograms since the start (cumulative)
+func (e *otlpExporter) export() error {
+	e.mu.Lock()
+	req := e.request(time.Now())
+	e.mu.Unlock()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("otlp export: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("otlp export: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *otlpExporter) request(now time.Time) otlpRequest {
+	var points []otlpExpHistogramPoint
+	var series []otlpSeries
+	if e.trackRx {
+		series = append(series, e.rx)
+	}
+	if e.trackTx {
+		series = append(series, e.tx)
+	}
+	series = append(series, e.classes...)
+	for _, s := range series {
+		p := expHistogramOf(s.hist)
+		p.Attributes = s.attributes
+		p.StartTimeUnixNano = strconv.FormatInt(e.start.UnixNano(), 10)
+		p.TimeUnixNano = strconv.FormatInt(now.UnixNano(), 10)
+		points = append(points, p)
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: e.resource},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "network-microburst"},
+			Metrics: []otlpMetric{{
+				Name:        "network.microburst.window.bytes",
+				Description: "Bytes in each burst window",
+				Unit:        "By",
+				ExponentialHistogram: otlpExpHistogram{
+					AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE,
+					DataPoints:             points,
+				},
+			}},
+		}},
+	}}}
+}
+
+// expHistogramOf converts the hdr histogram to an exponential one, the
+// values of each hdr bucket go to the exponential bucket of its lowest value
+func expHistogramOf(h *windowHist) otlpExpHistogramPoint {
+	p := otlpExpHistogramPoint{
+		Count: strconv.FormatInt(h.TotalCount(), 10),
+		Sum:   float64(h.sum),
+		Scale: OTLP_SCALE,
+	}
+	if h.TotalCount() == 0 {
+		p.ZeroCount = "0"
+		p.Positive.BucketCounts = []string{}
+		return p
+	}
+	lo, hi := float64(h.Min()), float64(h.Max())
+	p.Min, p.Max = &lo, &hi
+
+	var zero int64
+	counts := map[int]int64{}
+	first, last := math.MaxInt, math.MinInt
+	for _, bar := range h.Distribution() {
+		if bar.Count == 0 {
+			continue
+		}
+		if bar.From == 0 {
+			zero += bar.Count
+			continue
+		}
+		// bucket i is (2^(i/2^scale), 2^((i+1)/2^scale)]
+		i := int(math.Ceil(math.Log2(float64(bar.From))*(1<<OTLP_SCALE))) - 1
+		counts[i] += bar.Count
+		if i < first {
+			first = i
+		}
+		if i > last {
+			last = i
+		}
+	}
+
+	p.ZeroCount = strconv.FormatInt(zero, 10)
+	p.Positive.BucketCounts = []string{}
+	if len(counts) > 0 {
+		p.Positive.Offset = first
+		for i := first; i <= last; i++ {
+			p.Positive.BucketCounts = append(p.Positive.BucketCounts, strconv.FormatInt(counts[i], 10))
+		}
+	}
+	return p
+}
+
+// otlpRequest is the OTLP/HTTP JSON encoding of
+// ExportMetricsServiceRequest, the 64 bit integers are strings
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name                 string           `json:"name"`
+	Description          string           `json:"description"`
+	Unit                 string           `json:"unit"`
+	ExponentialHistogram otlpExpHistogram `json:"exponentialHistogram"`
+}
+
+type otlpExpHistogram struct {
+	AggregationTemporality int                     `json:"aggregationTemporality"`
+	DataPoints             []otlpExpHistogramPoint `json:"dataPoints"`
+}
+
+type otlpExpHistogramPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	Scale             int            `json:"scale"`
+	ZeroCount         string         `json:"zeroCount"`
+	Positive          otlpBuckets    `json:"positive"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+}
+
+type otlpBuckets struct {
+	Offset       int      `json:"offset"`
+	BucketCounts []string `json:"bucketCounts"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+func TestOtlpExporter(t *testing.T) {
+	// a stand-in for the collector
+	var mu sync.Mutex
+	var requests []otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	session := microburst.Session{Host: "db1", Kernel: "6.1.0", Interfaces: []string{"eth0"}, TrackRx: true}
+	classes := []microburst.Class{{Name: "multicast"}}
+	e, err := newOtlpExporter(srv.URL, time.Hour, session, classes)
+	require.NoError(t, err)
+
+	runSynthetic(t, `
+classes multicast
+0 0 0
+1024 0 0 x2
+1500000/1000 0 1000
+`, e)
+	require.NoError(t, e.Close())
+
+	require.Len(t, requests, 1)
+	rm := requests[0].ResourceMetrics[0]
+	require.Contains(t, rm.Resource.Attributes, otlpString("host.name", "db1"))
+	require.Contains(t, rm.Resource.Attributes, otlpString("os.version", "6.1.0"))
+	require.Contains(t, rm.Resource.Attributes, otlpString("network.interface.name", "eth0"))
+
+	metric := rm.ScopeMetrics[0].Metrics[0]
+	require.Equal(t, "network.microburst.window.bytes", metric.Name)
+	points := metric.ExponentialHistogram.DataPoints
+	// rx and multicast, tx is not tracked
+	require.Len(t, points, 2)
+
+	rx := points[0]
+	require.Equal(t, []otlpKeyValue{otlpString("direction", "rx")}, rx.Attributes)
+	require.Equal(t, "4", rx.Count)
+	require.Equal(t, "1", rx.ZeroCount)
+	require.Equal(t, float64(1502048), rx.Sum)
+	// 1024 is the upper bound of the bucket 79 at scale 3
+	require.Equal(t, 79, rx.Positive.Offset)
+	require.Equal(t, "2", rx.Positive.BucketCounts[0])
+	require.Equal(t, "1", rx.Positive.BucketCounts[len(rx.Positive.BucketCounts)-1])
+
+	require.Equal(t, []otlpKeyValue{otlpString("class", "multicast")}, points[1].Attributes)
+	require.Equal(t, "3", points[1].ZeroCount)
+
+	_, err = newOtlpExporter("localhost", time.Second, session, classes)
+	require.Error(t, err)
+}
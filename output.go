@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// newOutput is the sink printing the windows in the given format: text,
+// csv or jsonl
+func newOutput(format string, w io.Writer, classes []microburst.Class, window time.Duration) (microburst.Sink, error) {
+	raw := rawOutput{
+		rxThreshold: rxThreshold,
+		txThreshold: txThreshold,
+		trackRx:     options.TrackRx,
+		trackTx:     options.TrackTx,
+		classes:     classes,
+		packetSizes: options.PacketSizes,
+		incast:      options.Incast,
+		window:      window,
+	}
+
+	switch format {
+	case "text":
+		return newPrinter(w, classes), nil
+	case "csv":
+		return &csvOutput{rawOutput: raw, w: csv.NewWriter(w)}, nil
+	case "jsonl":
+		b := bufio.NewWriter(w)
+		return &jsonlOutput{rawOutput: raw, w: b, enc: json.NewEncoder(b)}, nil
+	default:
+		return nil, fmt.Errorf("invalid output %q, expected text, csv or jsonl", format)
+	}
+}
+
+// rawOutput is what the csv and jsonl outputs share: the windows above
+// the thresholds with raw integers
+type rawOutput struct {
+	rxThreshold uint64
+	txThreshold uint64
+	trackRx     bool
+	trackTx     bool
+	classes     []microburst.Class
+	packetSizes bool
+	incast      bool
+	// window is the measured window of the first sample
+	window   time.Duration
+	lastTime time.Time
+}
+
+// measure returns the time since the last window and if the window is
+// above the thresholds
+func (o *rawOutput) measure(s microburst.Sample) (time.Duration, bool) {
+	measured := o.window
+	if !o.lastTime.IsZero() {
+		measured = s.Time.Sub(o.lastTime)
+	}
+	o.lastTime = s.Time
+
+	above := (o.trackRx && s.RxBytes > o.rxThreshold) || (o.trackTx && s.TxBytes > o.txThreshold)
+	return measured, above
+}
+
+// directions are the tracked ones
+func (o *rawOutput) directions() []string {
+	var dirs []string
+	if o.trackRx {
+		dirs = append(dirs, "rx")
+	}
+	if o.trackTx {
+		dirs = append(dirs, "tx")
+	}
+	return dirs
+}
+
+// csvOutput writes a header and a row per window, the annotations are left
+// out
+type csvOutput struct {
+	rawOutput
+	w      *csv.Writer
+	header bool
+}
+
+func (o *csvOutput) columns() []string {
+	cols := []string{"time_ns", "window_ns"}
+	if o.trackRx {
+		cols = append(cols, "rx_bytes", "rx_packets")
+	}
+	if o.trackTx {
+		cols = append(cols, "tx_bytes", "tx_packets")
+	}
+	for _, class := range o.classes {
+		cols = append(cols, class.Name)
+	}
+	if o.packetSizes {
+		for _, dir := range o.directions() {
+			for _, bucket := range microburst.SizeBucketKeys {
+				cols = append(cols, dir+"_size_"+bucket)
+			}
+			cols = append(cols, dir+"_gso")
+		}
+	}
+	if o.incast {
+		cols = append(cols, "sources", "flows")
+	}
+	return cols
+}
+
+func (o *csvOutput) OnSample(s microburst.Sample) {
+	measured, above := o.measure(s)
+	if !above {
+		return
+	}
+
+	if !o.header {
+		o.w.Write(o.columns())
+		o.header = true
+	}
+
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	row := []string{strconv.FormatInt(s.Time.UnixNano(), 10), strconv.FormatInt(int64(measured), 10)}
+	if o.trackRx {
+		row = append(row, u(s.RxBytes), u(s.RxPackets))
+	}
+	if o.trackTx {
+		row = append(row, u(s.TxBytes), u(s.TxPackets))
+	}
+	for _, v := range s.Classes {
+		row = append(row, u(v))
+	}
+	if o.packetSizes {
+		var sizes []microburst.SizeHist
+		if o.trackRx {
+			sizes = append(sizes, s.RxSizes)
+		}
+		if o.trackTx {
+			sizes = append(sizes, s.TxSizes)
+		}
+		for _, h := range sizes {
+			for _, v := range h.Buckets {
+				row = append(row, u(v))
+			}
+			row = append(row, u(h.Gso))
+		}
+	}
+	if o.incast {
+		row = append(row, u(s.Sources), u(s.Flows))
+	}
+	o.w.Write(row)
+	// flushed per row, so the file can be followed while running
+	o.w.Flush()
+}
+
+func (o *csvOutput) OnAnnotation(a microburst.Annotation) {
+}
+
+// Close writes the header if there were no windows and flushes
+func (o *csvOutput) Close() error {
+	if !o.header {
+		o.w.Write(o.columns())
+	}
+	o.w.Flush()
+	return o.w.Error()
+}
+
+// jsonlOutput writes a JSON object per window and annotation, the fields of
+// the untracked directions are left out
+type jsonlOutput struct {
+	rawOutput
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+type jsonlWindow struct {
+	TimeNs    int64             `json:"time_ns"`
+	WindowNs  int64             `json:"window_ns"`
+	RxBytes   *uint64           `json:"rx_bytes,omitempty"`
+	RxPackets *uint64           `json:"rx_packets,omitempty"`
+	TxBytes   *uint64           `json:"tx_bytes,omitempty"`
+	TxPackets *uint64           `json:"tx_packets,omitempty"`
+	Classes   map[string]uint64 `json:"classes,omitempty"`
+	RxSizes   map[string]uint64 `json:"rx_sizes,omitempty"`
+	RxGso     *uint64           `json:"rx_gso,omitempty"`
+	TxSizes   map[string]uint64 `json:"tx_sizes,omitempty"`
+	TxGso     *uint64           `json:"tx_gso,omitempty"`
+	Sources   *uint64           `json:"sources,omitempty"`
+	Flows     *uint64           `json:"flows,omitempty"`
+}
+
+type jsonlAnnotation struct {
+	TimeNs     int64  `json:"time_ns"`
+	Annotation string `json:"annotation"`
+}
+
+func (o *jsonlOutput) OnSample(s microburst.Sample) {
+	measured, above := o.measure(s)
+	if !above {
+		return
+	}
+
+	rec := jsonlWindow{
+		TimeNs:   s.Time.UnixNano(),
+		WindowNs: int64(measured),
+	}
+	if o.trackRx {
+		rec.RxBytes, rec.RxPackets = &s.RxBytes, &s.RxPackets
+	}
+	if o.trackTx {
+		rec.TxBytes, rec.TxPackets = &s.TxBytes, &s.TxPackets
+	}
+	if len(o.classes) > 0 {
+		rec.Classes = make(map[string]uint64, len(o.classes))
+		for i, class := range o.classes {
+			rec.Classes[class.Name] = s.Classes[i]
+		}
+	}
+	if o.packetSizes && o.trackRx {
+		rec.RxSizes, rec.RxGso = sizesOf(s.RxSizes), &s.RxSizes.Gso
+	}
+	if o.packetSizes && o.trackTx {
+		rec.TxSizes, rec.TxGso = sizesOf(s.TxSizes), &s.TxSizes.Gso
+	}
+	if o.incast {
+		rec.Sources, rec.Flows = &s.Sources, &s.Flows
+	}
+	o.encode(rec)
+}
+
+func (o *jsonlOutput) OnAnnotation(a microburst.Annotation) {
+	o.encode(jsonlAnnotation{TimeNs: a.Time.UnixNano(), Annotation: a.Text})
+}
+
+// encode writes and flushes a line, so the file can be followed while
+// running. The first error is kept for Close
+func (o *jsonlOutput) encode(v any) {
+	if o.err == nil {
+		o.err = o.enc.Encode(v)
+	}
+	if o.err == nil {
+		o.err = o.w.Flush()
+	}
+}
+
+func (o *jsonlOutput) Close() error {
+	if o.err != nil {
+		return o.err
+	}
+	return o.w.Flush()
+}
+
+// sizesOf is the packets of each size bucket, by the bucket key
+func sizesOf(h microburst.SizeHist) map[string]uint64 {
+	sizes := make(map[string]uint64, len(h.Buckets))
+	for i, v := range h.Buckets {
+		sizes[microburst.SizeBucketKeys[i]] = v
+	}
+	return sizes
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+const outputScript = `
+classes multicast
+500/1 0 0
+1500000/1000 64/1 1000 x2
+@ filters changed
+`
+
+func TestCsvOutput(t *testing.T) {
+	var b bytes.Buffer
+	out, err := newOutput("csv", &b, []microburst.Class{{Name: "multicast"}}, time.Millisecond)
+	require.NoError(t, err)
+	out.(*csvOutput).rxThreshold = 1000
+	out.(*csvOutput).txThreshold = 1 << 40
+
+	runSynthetic(t, outputScript, out)
+	require.NoError(t, out.Close())
+
+	require.Equal(t, strings.Join([]string{
+		"time_ns,window_ns,rx_bytes,rx_packets,tx_bytes,tx_packets,multicast",
+		"1672567200001000000,1000000,1500000,1000,64,1,1000",
+		"1672567200002000000,1000000,1500000,1000,64,1,1000",
+		"",
+	}, "\n"), b.String())
+}
+
+func TestOutputSizes(t *testing.T) {
+	sample := microburst.Sample{
+		Time:    time.Unix(1672567200, 0),
+		RxBytes: 1500000,
+		RxSizes: microburst.SizeHist{Buckets: [microburst.NR_SIZE_BUCKETS]uint64{0: 2, 4: 3, 10: 1}, Gso: 1},
+	}
+
+	// the rows are written out without waiting for Close
+	var b bytes.Buffer
+	out, err := newOutput("csv", &b, nil, time.Millisecond)
+	require.NoError(t, err)
+	o := out.(*csvOutput)
+	o.trackRx, o.trackTx, o.packetSizes = true, false, true
+	out.OnSample(sample)
+	require.Equal(t, strings.Join([]string{
+		"time_ns,window_ns,rx_bytes,rx_packets,rx_size_lt128,rx_size_128_255,rx_size_256_511,rx_size_512_1023,rx_size_1k_2k,rx_size_2k_4k,rx_size_4k_8k,rx_size_8k_16k,rx_size_16k_32k,rx_size_32k_64k,rx_size_64k_plus,rx_gso",
+		"1672567200000000000,1000000,1500000,0,2,0,0,0,3,0,0,0,0,0,1,1",
+		"",
+	}, "\n"), b.String())
+	require.NoError(t, out.Close())
+
+	b.Reset()
+	out, err = newOutput("jsonl", &b, nil, time.Millisecond)
+	require.NoError(t, err)
+	j := out.(*jsonlOutput)
+	j.trackRx, j.trackTx, j.packetSizes = true, false, true
+	out.OnSample(sample)
+	require.Contains(t, b.String(), `"rx_sizes":{"128_255":0,"16k_32k":0,"1k_2k":3,`)
+	require.Contains(t, b.String(), `"64k_plus":1,"8k_16k":0,"lt128":2},"rx_gso":1}`)
+	require.NoError(t, out.Close())
+}
+
+func TestJsonlOutput(t *testing.T) {
+	var b bytes.Buffer
+	out, err := newOutput("jsonl", &b, []microburst.Class{{Name: "multicast"}}, time.Millisecond)
+	require.NoError(t, err)
+	out.(*jsonlOutput).rxThreshold = 1000
+	out.(*jsonlOutput).trackTx = false
+
+	runSynthetic(t, outputScript, out)
+	require.NoError(t, out.Close())
+
+	require.Equal(t, strings.Join([]string{
+		`{"time_ns":1672567200001000000,"window_ns":1000000,"rx_bytes":1500000,"rx_packets":1000,"classes":{"multicast":1000}}`,
+		`{"time_ns":1672567200002000000,"window_ns":1000000,"rx_bytes":1500000,"rx_packets":1000,"classes":{"multicast":1000}}`,
+		`{"time_ns":1672567200003000000,"annotation":"filters changed"}`,
+		"",
+	}, "\n"), b.String())
+
+	_, err = newOutput("xml", &b, nil, time.Millisecond)
+	require.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package microburst
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// tcAttachment is the tc clsact setup on an interface, to be undone at
+// exit
+type tcAttachment struct {
+	iface   string
+	hooks   []*bpf.TcHook
+	opts    []bpf.TcOpts
+	created bool
+	module  *bpf.Module
+}
+
+// attachTc attaches the given ingress/egress programs to the tc clsact
+// qdisc of the interface, creating the qdisc if needed. Empty program
+// name skips that direction.
+func attachTc(module *bpf.Module, iface string, ingressProg string, egressProg string, debug bool) (*tcAttachment, error) {
+	a := &tcAttachment{
+		iface:  iface,
+		module: module,
+	}
+
+	for _, p := range []struct {
+		name  string
+		point bpf.TcAttachPoint
+	}{
+		{ingressProg, bpf.BPFTcIngress},
+		{egressProg, bpf.BPFTcEgress},
+	} {
+		if p.name == "" {
+			continue
+		}
+
+		prog, err := module.GetProgram(p.name)
+		if err != nil {
+			a.detach()
+			return nil, err
+		}
+
+		hook := module.TcHookInit()
+		err = hook.SetInterfaceByName(iface)
+		if err != nil {
+			a.detach()
+			return nil, fmt.Errorf("failed to set tc hook on %s: %w", iface, err)
+		}
+		hook.SetAttachPoint(p.point)
+
+		err = hook.Create()
+		if err == nil {
+			a.created = true
+		} else if !errors.Is(err, syscall.EEXIST) {
+			a.detach()
+			return nil, fmt.Errorf("failed to create clsact qdisc on %s: %w", iface, err)
+		}
+
+		opts := bpf.TcOpts{ProgFd: prog.FileDescriptor()}
+		err = hook.Attach(&opts)
+		if err != nil {
+			a.detach()
+			return nil, fmt.Errorf("failed to attach program (%s) to %s: %w", p.name, iface, err)
+		}
+
+		if debug {
+			log.Printf("attached program %q to %s (handle %d, priority %d)", p.name, iface, opts.Handle, opts.Priority)
+		}
+
+		a.hooks = append(a.hooks, hook)
+		a.opts = append(a.opts, opts)
+	}
+
+	return a, nil
+}
+
+// detach removes our filters, and the clsact qdisc as well if we created
+// it
+func (a *tcAttachment) detach() {
+	for i, hook := range a.hooks {
+		// bpf_tc_detach wants only the handle and priority
+		opts := bpf.TcOpts{
+			Handle:   a.opts[i].Handle,
+			Priority: a.opts[i].Priority,
+		}
+		if err := hook.Detach(&opts); err != nil {
+			log.Printf("failed to detach tc program from %s: %v", a.iface, err)
+		}
+	}
+	a.hooks = nil
+	a.opts = nil
+
+	if a.created {
+		hook := a.module.TcHookInit()
+		if err := hook.SetInterfaceByName(a.iface); err != nil {
+			log.Printf("failed to remove clsact qdisc from %s: %v", a.iface, err)
+			return
+		}
+		hook.SetAttachPoint(bpf.BPFTcIngressEgress)
+		if err := hook.Destroy(); err != nil {
+			log.Printf("failed to remove clsact qdisc from %s: %v", a.iface, err)
+		}
+		a.created = false
+	}
+}
+
+func attachXdp(module *bpf.Module, iface string, progName string, debug bool) error {
+	prog, err := module.GetProgram(progName)
+	if err != nil {
+		return err
+	}
+
+	// The link is destroyed when the module is closed
+	_, err = prog.AttachXDP(iface)
+	if err != nil {
+		return fmt.Errorf("failed to attach program (%s) to %s: %w", progName, iface, err)
+	}
+
+	if debug {
+		log.Printf("attached program %q to %s", progName, iface)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package microburst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aquasecurity/libbpfgo/helpers"
+)
+
+// findBtf looks up the BTF file matching the running kernel in the given
+// directory. Both a flat directory (<dir>/<release>.btf) and the BTFHub
+// archive layout (<dir>/<os id>/<os version>/<arch>/<release>.btf) are
+// supported. The BTFHub files are compressed, they need to be extracted
+// beforehand.
+func findBtf(dir string) (string, error) {
+	osInfo, err := helpers.GetOSInfo()
+	if err != nil {
+		return "", fmt.Errorf("could not get os info: %w", err)
+	}
+
+	release := osInfo.GetOSReleaseFieldValue(helpers.OS_KERNEL_RELEASE)
+	candidates := btfCandidates(dir, release,
+		osInfo.GetOSReleaseFieldValue(helpers.OS_ID),
+		osInfo.GetOSReleaseFieldValue(helpers.OS_VERSION_ID),
+		osInfo.GetOSReleaseFieldValue(helpers.OS_ARCH))
+
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("no BTF for kernel %s found in %s (tried %s)", release, dir, strings.Join(candidates, ", "))
+}
+
+func btfCandidates(dir, release, osID, osVersion, arch string) []string {
+	// BTFHub names the arches the same way as the kernel does
+	if arch == "aarch64" {
+		arch = "arm64"
+	}
+
+	candidates := []string{
+		filepath.Join(dir, release+".btf"),
+	}
+	if osID != "" && osVersion != "" {
+		candidates = append(candidates, filepath.Join(dir, osID, osVersion, arch, release+".btf"))
+	}
+
+	return candidates
+}
+
+// Where the running kernel exposes its BTF
+const KERNEL_BTF_PATH = "/sys/kernel/btf/vmlinux"
+
+// BTF kinds, from include/uapi/linux/btf.h
+const (
+	BTF_MAGIC           = 0xeb9f
+	BTF_KIND_INT        = 1
+	BTF_KIND_PTR        = 2
+	BTF_KIND_ARRAY      = 3
+	BTF_KIND_STRUCT     = 4
+	BTF_KIND_UNION      = 5
+	BTF_KIND_ENUM       = 6
+	BTF_KIND_FWD        = 7
+	BTF_KIND_TYPEDEF    = 8
+	BTF_KIND_VOLATILE   = 9
+	BTF_KIND_CONST      = 10
+	BTF_KIND_RESTRICT   = 11
+	BTF_KIND_FUNC       = 12
+	BTF_KIND_FUNC_PROTO = 13
+	BTF_KIND_VAR        = 14
+	BTF_KIND_DATASEC    = 15
+	BTF_KIND_FLOAT      = 16
+	BTF_KIND_DECL_TAG   = 17
+	BTF_KIND_TYPE_TAG   = 18
+	BTF_KIND_ENUM64     = 19
+)
+
+// btfType is the part of a BTF type we need: the name, what it refers to
+// and the parameter types of a function prototype
+type btfType struct {
+	name   string
+	kind   uint32
+	ref    uint32
+	params []uint32
+}
+
+// readBtf reads the types of a raw BTF file (like /sys/kernel/btf/vmlinux
+// or the BTFHub ones), indexed by the type id
+func readBtf(path string) ([]btfType, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 24 {
+		return nil, fmt.Errorf("%s: not a BTF file", path)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint16(b) == BTF_MAGIC {
+		order = binary.BigEndian
+	} else if order.Uint16(b) != BTF_MAGIC {
+		return nil, fmt.Errorf("%s: not a BTF file", path)
+	}
+	hdrLen := order.Uint32(b[4:])
+	typeOff, typeLen := order.Uint32(b[8:]), order.Uint32(b[12:])
+	strOff, strLen := order.Uint32(b[16:]), order.Uint32(b[20:])
+	if uint64(hdrLen)+uint64(typeOff)+uint64(typeLen) > uint64(len(b)) || uint64(hdrLen)+uint64(strOff)+uint64(strLen) > uint64(len(b)) {
+		return nil, fmt.Errorf("%s: truncated BTF", path)
+	}
+	typeSec := b[hdrLen+typeOff : hdrLen+typeOff+typeLen]
+	strSec := b[hdrLen+strOff : hdrLen+strOff+strLen]
+
+	str := func(off uint32) string {
+		if off >= uint32(len(strSec)) {
+			return ""
+		}
+		s := strSec[off:]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return string(s)
+	}
+
+	// type id 0 is void
+	types := []btfType{{}}
+	for off := 0; off+12 <= len(typeSec); {
+		info := order.Uint32(typeSec[off+4:])
+		t := btfType{
+			name: str(order.Uint32(typeSec[off:])),
+			kind: info >> 24 & 0x1f,
+			ref:  order.Uint32(typeSec[off+8:]),
+		}
+		vlen := int(info & 0xffff)
+		off += 12
+
+		var extra int
+		switch t.kind {
+		case BTF_KIND_INT, BTF_KIND_VAR, BTF_KIND_DECL_TAG:
+			extra = 4
+		case BTF_KIND_ARRAY:
+			extra = 12
+		case BTF_KIND_STRUCT, BTF_KIND_UNION, BTF_KIND_DATASEC, BTF_KIND_ENUM64:
+			extra = 12 * vlen
+		case BTF_KIND_ENUM:
+			extra = 8 * vlen
+		case BTF_KIND_FUNC_PROTO:
+			extra = 8 * vlen
+			for i := 0; i < vlen && off+i*8+8 <= len(typeSec); i++ {
+				t.params = append(t.params, order.Uint32(typeSec[off+i*8+4:]))
+			}
+		}
+		off += extra
+
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+// BTF_MAX_TYPE_CHAIN is how many pointers and modifiers are followed, a
+// longer (or cyclic) chain is a malformed BTF file
+const BTF_MAX_TYPE_CHAIN = 32
+
+// btfParamPointerDepth tells how many pointers deep the given parameter of
+// the function is, like 2 for struct sk_buff **
+func btfParamPointerDepth(types []btfType, fn string, param int) (int, error) {
+	for _, t := range types {
+		if t.kind != BTF_KIND_FUNC || t.name != fn {
+			continue
+		}
+		if t.ref >= uint32(len(types)) || types[t.ref].kind != BTF_KIND_FUNC_PROTO {
+			return 0, fmt.Errorf("%s has no prototype", fn)
+		}
+		params := types[t.ref].params
+		if param >= len(params) {
+			return 0, fmt.Errorf("%s has only %d parameters", fn, len(params))
+		}
+
+		depth := 0
+		hops := 0
+		for id := params[param]; id != 0 && id < uint32(len(types)); id = types[id].ref {
+			hops++
+			if hops > BTF_MAX_TYPE_CHAIN {
+				return 0, fmt.Errorf("%s parameter %d: type chain longer than %d", fn, param, BTF_MAX_TYPE_CHAIN)
+			}
+			switch types[id].kind {
+			case BTF_KIND_PTR:
+				depth++
+			case BTF_KIND_TYPEDEF, BTF_KIND_CONST, BTF_KIND_VOLATILE, BTF_KIND_RESTRICT, BTF_KIND_TYPE_TAG:
+			default:
+				return depth, nil
+			}
+		}
+		return depth, nil
+	}
+
+	return 0, fmt.Errorf("%s not found", fn)
+}
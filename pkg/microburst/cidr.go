@@ -0,0 +1,187 @@
+package microburst
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// Same as MAX_FILTER_CIDRS in the bpf code
+const MAX_FILTER_CIDRS = 1024
+
+// cidrKeySize is the size of struct cidr_key in the bpf code
+const cidrKeySize = 20
+
+// parseCidrs parses a comma separated list of CIDRs (or addresses) into
+// the LPM trie keys of the bpf code, i.e., prefix length followed by the
+// IPv6 address, with IPv4 ones as IPv4-mapped IPv6 addresses
+func parseCidrs(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		var ip net.IP
+		var ones int
+		if strings.Contains(v, "/") {
+			_, ipNet, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q", v)
+			}
+			ip = ipNet.IP
+			ones, _ = ipNet.Mask.Size()
+		} else {
+			ip = net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			ones = 128
+			if ip.To4() != nil {
+				ones = 32
+			}
+		}
+
+		if ip.To4() != nil && ones <= 32 {
+			ones += 96
+		}
+
+		key := make([]byte, cidrKeySize)
+		key[0] = byte(ones)
+		copy(key[4:], ip.To16())
+		keys[string(key)] = key
+	}
+
+	if len(keys) > MAX_FILTER_CIDRS {
+		return nil, fmt.Errorf("too many cidrs %d (max %d)", len(keys), MAX_FILTER_CIDRS)
+	}
+
+	return keys, nil
+}
+
+// parsePorts parses a comma separated list of ports and port ranges (like
+// "443,8000-8100")
+func parsePorts(s string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(v, "-")
+		if !isRange {
+			hi = lo
+		}
+		portLo, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", v)
+		}
+		portHi, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || portLo > portHi {
+			return nil, fmt.Errorf("invalid port range %q", v)
+		}
+
+		for p := portLo; p <= portHi; p++ {
+			ports[uint16(p)] = true
+		}
+	}
+
+	return ports, nil
+}
+
+// syncCidrs makes the LPM trie map hold the given keys. The new keys are
+// added before removing the old ones, so a packet may briefly match either.
+func syncCidrs(module *bpf.Module, mapName string, old, new map[string][]byte) error {
+	m, err := module.GetMap(mapName)
+	if err != nil {
+		return err
+	}
+
+	one := uint8(1)
+	for k, key := range new {
+		if _, ok := old[k]; ok {
+			continue
+		}
+		err = m.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&one))
+		if err != nil {
+			return fmt.Errorf("update %s: %w", mapName, err)
+		}
+	}
+
+	for k, key := range old {
+		if _, ok := new[k]; ok {
+			continue
+		}
+		err = m.DeleteKey(unsafe.Pointer(&key[0]))
+		if err != nil {
+			return fmt.Errorf("delete from %s: %w", mapName, err)
+		}
+	}
+
+	return nil
+}
+
+// syncPorts makes the filter_ports map hold the given ports, same as
+// syncCidrs
+func syncPorts(module *bpf.Module, old, new map[uint16]bool) error {
+	m, err := module.GetMap("filter_ports")
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []struct {
+		ports map[uint16]bool
+		skip  map[uint16]bool
+		value uint8
+	}{
+		{new, old, 1},
+		{old, new, 0},
+	} {
+		for port := range p.ports {
+			if p.skip[port] {
+				continue
+			}
+			key := uint32(port)
+			value := p.value
+			err = m.Update(unsafe.Pointer(&key), unsafe.Pointer(&value))
+			if err != nil {
+				return fmt.Errorf("update filter_ports: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreCidrs puts the LPM trie map back to old after syncCidrs to new
+// failed part way. The keys of new that weren't added fail to delete, that
+// is ignored.
+func restoreCidrs(module *bpf.Module, mapName string, old, new map[string][]byte) error {
+	m, err := module.GetMap(mapName)
+	if err != nil {
+		return err
+	}
+
+	one := uint8(1)
+	for _, key := range old {
+		err = m.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&one))
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", mapName, err)
+		}
+	}
+	for k, key := range new {
+		if _, ok := old[k]; !ok {
+			m.DeleteKey(unsafe.Pointer(&key[0]))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package microburst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCidrs(t *testing.T) {
+	keys, err := parseCidrs("10.1.0.0/16, 192.168.1.1,2001:db8::/32")
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+
+	v4 := []byte{96 + 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 1, 0, 0}
+	require.Contains(t, keys, string(v4))
+
+	host := []byte{128, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 1, 1}
+	require.Contains(t, keys, string(host))
+
+	v6 := []byte{32, 0, 0, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	require.Contains(t, keys, string(v6))
+
+	keys, err = parseCidrs("")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	_, err = parseCidrs("10.0.0.0/33")
+	require.Error(t, err)
+	_, err = parseCidrs("example.com")
+	require.Error(t, err)
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("443, 8000-8002")
+	require.NoError(t, err)
+	require.Equal(t, map[uint16]bool{443: true, 8000: true, 8001: true, 8002: true}, ports)
+
+	ports, err = parsePorts("65535")
+	require.NoError(t, err)
+	require.Equal(t, map[uint16]bool{65535: true}, ports)
+
+	for _, s := range []string{"http", "10-1", "65536", "1-"} {
+		_, err = parsePorts(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,104 @@
+package microburst
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// Same as the max_entries of attached_ifindexes in the bpf code
+const MAX_ATTACHED_IFACES = 64
+
+// Class is a subset of the traffic tracked as a separate series, next to
+// the rx and tx ones
+type Class struct {
+	// Name is the short name, like "multicast" or "rx:dscp=ef"
+	Name string
+	// Title is the name for the graphs, like "Received multicast"
+	Title string
+	key   int
+}
+
+// rxClasses are the classes of the received packets, by skb->pkt_type
+// and by the routing result
+var rxClasses = map[string]Class{
+	"unicast":   {"unicast", "Received unicast", RX_HOST_BYTES},
+	"broadcast": {"broadcast", "Received broadcast", RX_BROADCAST_BYTES},
+	"multicast": {"multicast", "Received multicast", RX_MULTICAST_BYTES},
+	"otherhost": {"otherhost", "Received for other hosts", RX_OTHERHOST_BYTES},
+	"local":     {"local", "Received for local delivery", RX_LOCAL_BYTES},
+	"forwarded": {"forwarded", "Received and forwarded", RX_FORWARDED_BYTES},
+}
+
+// routingClassPrograms are the programs needed for the local and
+// forwarded classes
+var routingClassPrograms = []string{
+	"kprobe_ip_local_deliver",
+	"kprobe_ip6_input",
+	"kprobe_ip_forward",
+	"kprobe_ip6_forward",
+}
+
+// parseRxClasses parses the comma separated list of rx classes to track
+func parseRxClasses(s string) ([]Class, error) {
+	var classes []Class
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+
+		c, ok := rxClasses[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid rx class %q", name)
+		}
+		classes = append(classes, c)
+		seen[name] = true
+	}
+
+	return classes, nil
+}
+
+// needRoutingClasses tells if any of the classes need the routing probes
+func needRoutingClasses(classes []Class) bool {
+	for _, c := range classes {
+		if c.key == RX_LOCAL_BYTES || c.key == RX_FORWARDED_BYTES {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIfindexes puts the interfaces the tc/xdp programs are attached to in
+// attached_ifindexes, the routing probes count only the packets received on
+// them
+func loadIfindexes(module *bpf.Module, interfaces []string) error {
+	if len(interfaces) > MAX_ATTACHED_IFACES {
+		return fmt.Errorf("local and forwarded classes support at most %d interfaces", MAX_ATTACHED_IFACES)
+	}
+
+	m, err := module.GetMap("attached_ifindexes")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		key := uint32(iface.Index)
+		value := uint8(1)
+		err = m.Update(unsafe.Pointer(&key), unsafe.Pointer(&value))
+		if err != nil {
+			return fmt.Errorf("update attached_ifindexes: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package microburst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRxClasses(t *testing.T) {
+	c, err := parseRxClasses("forwarded, local,forwarded,multicast")
+	require.NoError(t, err)
+	require.Len(t, c, 3)
+	require.Equal(t, RX_FORWARDED_BYTES, c[0].key)
+	require.Equal(t, RX_LOCAL_BYTES, c[1].key)
+	require.Equal(t, RX_MULTICAST_BYTES, c[2].key)
+	require.True(t, needRoutingClasses(c))
+
+	c, err = parseRxClasses("unicast,broadcast")
+	require.NoError(t, err)
+	require.False(t, needRoutingClasses(c))
+
+	c, err = parseRxClasses("")
+	require.NoError(t, err)
+	require.Empty(t, c)
+
+	_, err = parseRxClasses("transit")
+	require.Error(t, err)
+}
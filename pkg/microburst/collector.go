@@ -0,0 +1,716 @@
+// Package microburst tracks the bytes sent and received in small windows
+// (like 1ms) using bpf, to find the microbursts that the usual per second
+// counters average out.
+package microburst
+
+import (
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/prometheus/procfs"
+)
+
+//go:embed network-microburst.bpf.o
+var defaultBpfBin []byte
+
+//go:embed network-microburst.bpf.per_cpu_legacy.o
+var userspaceTimerBpfBin []byte
+
+const defaultBpfName = "network-microburst.bpf.o"
+const userspaceTimerBpfName = "network-microburst.bpf.per_cpu_legacy.o"
+
+// How many samples and annotations are buffered for a slow consumer, the
+// newer ones are dropped once these are full
+const (
+	SAMPLE_BUFFER     = 500
+	ANNOTATION_BUFFER = 10
+)
+
+// Keys of txrx_info, same as enum counter in the bpf code. The events
+// carry the values in this order as well.
+const (
+	RX_BYTES = iota
+	TX_BYTES
+	RX_PACKETS
+	TX_PACKETS
+	RX_HOST_BYTES
+	RX_BROADCAST_BYTES
+	RX_MULTICAST_BYTES
+	RX_OTHERHOST_BYTES
+	RX_LOCAL_BYTES
+	RX_FORWARDED_BYTES
+	// a counter per group slot
+	GROUP_RX_BYTES
+	GROUP_TX_BYTES = GROUP_RX_BYTES + MAX_GROUPS
+	// packets per size bucket, then the GSO/GRO packets
+	RX_SIZE_PACKETS = GROUP_TX_BYTES + MAX_GROUPS
+	TX_SIZE_PACKETS = RX_SIZE_PACKETS + NR_SIZE_COUNTERS
+	// bits set in the incast bitmaps
+	RX_SOURCES  = TX_SIZE_PACKETS + NR_SIZE_COUNTERS
+	RX_FLOWS    = RX_SOURCES + 1
+	NR_COUNTERS = RX_FLOWS + 1
+)
+
+// Options is what to track and how. The string lists are comma separated,
+// same as the command line flags.
+type Options struct {
+	// Window is the burst window, the metrics are tracked by this
+	// granularity
+	Window time.Duration
+	// Timer is auto, perf, perf-percpu, go or bpf
+	Timer string
+	// PerfCpu is the cpu to use for the perf timer, -1 picks one
+	PerfCpu int
+	// Attach is auto, tp_btf, raw_tp, kprobe, tc or xdp. tc and xdp
+	// attach to the interfaces in Filters.Interface.
+	Attach  string
+	TrackRx bool
+	TrackTx bool
+	// GsoSegments accounts GSO/GRO packets as the segments on the wire
+	GsoSegments bool
+	// Accounting is skb, l3, l2 or wire
+	Accounting string
+	// BtfPath is an external BTF file, BtfDir a directory to look it up
+	// in when BtfPath is not given
+	BtfPath string
+	BtfDir  string
+	Filters Filters
+	// RxClasses are unicast, broadcast, multicast, otherhost, local or
+	// forwarded
+	RxClasses      string
+	DscpGroups     string
+	PriorityGroups string
+	MarkGroups     string
+	VniGroups      string
+	Decap          bool
+	PacketSizes    bool
+	Incast         bool
+	Debug          bool
+}
+
+// DefaultOptions are the same as the command line defaults
+func DefaultOptions() Options {
+	return Options{
+		Window:     time.Millisecond,
+		Timer:      "auto",
+		PerfCpu:    -1,
+		Attach:     "auto",
+		TrackRx:    true,
+		TrackTx:    true,
+		Accounting: "skb",
+	}
+}
+
+// Backend is what was picked for the running kernel
+type Backend struct {
+	// Features are the probed kernel features
+	Features string
+	Timer    string
+	// Object is the name of the bpf object used
+	Object string
+	// Reason tells why the timer was picked
+	Reason  string
+	Attach  string
+	BtfPath string
+}
+
+// Sample is a burst window
+type Sample struct {
+	// Time is the end of the window
+	Time      time.Time
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	// Classes are the bytes of each of the Classes(), in the same order
+	Classes []uint64
+	// RxSizes and TxSizes are set with PacketSizes
+	RxSizes SizeHist
+	TxSizes SizeHist
+	// Sources and Flows are the estimated distinct sources and flows of
+	// the received packets, set with Incast
+	Sources uint64
+	Flows   uint64
+}
+
+// Collector loads the bpf programs and publishes a Sample per window
+type Collector struct {
+	opts    Options
+	backend Backend
+	bpfBin  []byte
+	classes []Class
+	groups  []group
+	// same mask of all the mark groups
+	groupMarkMask uint32
+	interfaces    []string
+	numCpus       int
+	btime         uint64
+
+	module  *bpf.Module
+	filters *filterState
+	// run in reverse order on Stop
+	closers []func()
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	stopped     bool
+	err         error
+	samples     chan Sample
+	annotations chan Annotation
+	// windows dropped because the consumer couldn't keep up
+	dropped atomic.Uint64
+}
+
+type rxTxStats struct {
+	rxBytes   uint64
+	txBytes   uint64
+	rxPackets uint64
+	txPackets uint64
+	// all the counters, indexed by the keys above
+	values [NR_COUNTERS]uint64
+	time   time.Time
+}
+
+func newRxTxStats(t time.Time, values [NR_COUNTERS]uint64) rxTxStats {
+	return rxTxStats{
+		rxBytes:   values[RX_BYTES],
+		txBytes:   values[TX_BYTES],
+		rxPackets: values[RX_PACKETS],
+		txPackets: values[TX_PACKETS],
+		values:    values,
+		time:      t,
+	}
+}
+
+// accountingModes maps the accounting option to enum accounting_mode in the
+// bpf code
+var accountingModes = map[string]uint8{
+	"skb":  0,
+	"l3":   1,
+	"l2":   2,
+	"wire": 3,
+}
+
+// decodeCounters reads NR_COUNTERS little endian values from b
+func decodeCounters(b []byte) [NR_COUNTERS]uint64 {
+	var values [NR_COUNTERS]uint64
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint64(b[i*8 : i*8+8])
+	}
+	return values
+}
+
+// New checks the options and picks the backend for the running kernel,
+// nothing is loaded till Start
+func New(opts Options) (*Collector, error) {
+	if opts.Window <= 0 {
+		return nil, fmt.Errorf("invalid burst window %s", opts.Window)
+	}
+	if _, ok := accountingModes[opts.Accounting]; !ok {
+		return nil, fmt.Errorf("invalid accounting option %q", opts.Accounting)
+	}
+	switch opts.Timer {
+	case "auto", "perf", "perf-percpu", "go", "bpf":
+	default:
+		return nil, fmt.Errorf("invalid timer option %q", opts.Timer)
+	}
+
+	c := &Collector{
+		opts:        opts,
+		samples:     make(chan Sample, SAMPLE_BUFFER),
+		annotations: make(chan Annotation, ANNOTATION_BUFFER),
+	}
+
+	feat := probeFeatures()
+	c.backend.Features = feat.String()
+	c.backend.Timer, c.bpfBin, c.backend.Object, c.backend.Reason = chooseBackend(feat, opts.Timer)
+
+	var err error
+	c.backend.BtfPath = opts.BtfPath
+	if c.backend.BtfPath == "" && opts.BtfDir != "" {
+		c.backend.BtfPath, err = findBtf(opts.BtfDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.backend.Attach, err = chooseAttach(feat, opts.Attach, c.backend.BtfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.classes, err = parseRxClasses(opts.RxClasses)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.classes) > 0 && !opts.TrackRx {
+		return nil, errors.New("rx-classes needs track-rx")
+	}
+	if needRoutingClasses(c.classes) && !feat.btf && c.backend.BtfPath == "" {
+		return nil, fmt.Errorf("local and forwarded classes need the kernel BTF (%s) or an external one given by btf-path or btf-dir", KERNEL_BTF_PATH)
+	}
+
+	c.groups, c.groupMarkMask, err = parseGroups(opts.DscpGroups, opts.PriorityGroups, opts.MarkGroups, opts.VniGroups)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MarkGroups != "" && !opts.TrackTx {
+		return nil, errors.New("mark-groups needs track-tx, the received packets are not marked yet")
+	}
+	if opts.VniGroups != "" && !opts.Decap {
+		return nil, errors.New("vni-groups needs decap")
+	}
+	if opts.Incast && !opts.TrackRx {
+		return nil, errors.New("incast needs track-rx")
+	}
+	c.classes = append(c.classes, groupClasses(c.groups, opts.TrackRx, opts.TrackTx)...)
+
+	if _, _, _, _, err := opts.Filters.compile(); err != nil {
+		return nil, err
+	}
+	if opts.Filters.Interface != "" {
+		c.interfaces = strings.Split(opts.Filters.Interface, ",")
+	}
+	if (c.backend.Attach == "tc" || c.backend.Attach == "xdp") && len(c.interfaces) == 0 {
+		return nil, fmt.Errorf("filter-interface is required with attach=%s", c.backend.Attach)
+	}
+
+	fs, err := procfs.NewFS("/proc")
+	if err != nil {
+		return nil, err
+	}
+	stats, err := fs.Stat()
+	if err != nil {
+		return nil, err
+	}
+	c.btime = stats.BootTime
+
+	// We will calculate num cpus from /proc/cpuinfo, as we may be
+	// running under taskset to run on a subset of cpus and
+	// runtime.NumCPU() will not show all the physical cpus, which we
+	// require in bpf code
+	cpus, err := fs.CPUInfo()
+	if err != nil {
+		return nil, err
+	}
+	c.numCpus = len(cpus)
+
+	return c, nil
+}
+
+// Backend is the timer and the programs picked for the running kernel
+func (c *Collector) Backend() Backend {
+	return c.backend
+}
+
+// Classes are the series tracked next to the rx and tx ones, the values of
+// Sample.Classes are in this order
+func (c *Collector) Classes() []Class {
+	return c.classes
+}
+
+// Samples are the windows, the channel is closed on Stop. The windows are
+// dropped if the consumer can't keep up.
+func (c *Collector) Samples() <-chan Sample {
+	return c.samples
+}
+
+// Annotations are the filter changes, the channel is closed on Stop
+func (c *Collector) Annotations() <-chan Annotation {
+	return c.annotations
+}
+
+// Done is closed once the collector stops, either by Stop, the context
+// given to Start or an error. Stop returns the error. Before Start it is
+// nil, i.e., never done.
+func (c *Collector) Done() <-chan struct{} {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Done()
+}
+
+// Start loads and attaches the bpf programs and starts the timer, the
+// samples are published till ctx is done or Stop is called
+func (c *Collector) Start(ctx context.Context) error {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	err := c.start()
+	if err != nil {
+		c.cancel()
+		c.wg.Wait()
+		c.close()
+		return err
+	}
+
+	return nil
+}
+
+func (c *Collector) start() error {
+	module, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: c.bpfBin,
+		BPFObjName: c.backend.Object,
+		BTFObjPath: c.backend.BtfPath,
+	})
+	if err != nil {
+		return err
+	}
+	c.module = module
+	c.closers = append(c.closers, module.Close)
+
+	err = c.initGlobals()
+	if err != nil {
+		return err
+	}
+
+	// syscall programs need a newer kernel (5.14+), so load it only when
+	// asked for
+	timerProg, err := module.GetProgram("start_metrics_timer")
+	if err != nil {
+		return err
+	}
+	err = timerProg.SetAutoload(c.backend.Timer == "bpf")
+	if err != nil {
+		return err
+	}
+
+	// Load only the programs for the chosen attach mode, the others may
+	// not even load in this kernel (like tp_btf without kernel BTF)
+	progs := attachPrograms[c.backend.Attach]
+	for _, names := range attachPrograms {
+		for _, name := range names {
+			prog, err := module.GetProgram(name)
+			if err != nil {
+				return err
+			}
+			err = prog.SetAutoload(name == progs[0] || name == progs[1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Probes for the local/forwarded classes are loaded only when asked
+	// for
+	for _, name := range routingClassPrograms {
+		prog, err := module.GetProgram(name)
+		if err != nil {
+			return err
+		}
+		err = prog.SetAutoload(needRoutingClasses(c.classes))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = module.BPFLoadObject()
+	if err != nil {
+		return err
+	}
+
+	// The filters are in maps, so that they can be changed while running
+	filters := newFilterState(module, c.backend.Attach, c.annotate)
+	err = filters.init(c.opts.Filters)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.filters = filters
+	c.mu.Unlock()
+
+	err = loadGroups(module, c.groups)
+	if err != nil {
+		return err
+	}
+
+	err = c.attach(progs)
+	if err != nil {
+		return err
+	}
+
+	return c.startTimer()
+}
+
+// global is a const volatile variable of the bpf code
+type global struct {
+	name  string
+	value interface{}
+}
+
+func (c *Collector) initGlobals() error {
+	globals := []global{
+		{"nr_cpus", uint32(c.numCpus)},
+		{"timer_interval_ns", uint64(c.opts.Window.Nanoseconds())},
+		{"gso_segments", boolToUint8(c.opts.GsoSegments)},
+		{"accounting", accountingModes[c.opts.Accounting]},
+		{"group_kinds", groupKinds(c.groups)},
+		{"group_mark_mask", c.groupMarkMask},
+		{"decap", boolToUint8(c.opts.Decap)},
+		{"track_sizes", boolToUint8(c.opts.PacketSizes)},
+		{"track_incast", boolToUint8(c.opts.Incast)},
+		{"filter_ifindex", boolToUint8(c.backend.Attach == "tc" || c.backend.Attach == "xdp")},
+	}
+	if c.backend.Attach == "kprobe" {
+		btfPath := c.backend.BtfPath
+		if btfPath == "" {
+			btfPath = KERNEL_BTF_PATH
+		}
+		pskb, err := kprobeRxTakesPskb(btfPath)
+		if err != nil {
+			return err
+		}
+		globals = append(globals, global{"rx_kprobe_pskb", boolToUint8(pskb)})
+	}
+
+	for _, g := range globals {
+		err := c.module.InitGlobalVariable(g.name, g.value)
+		if err != nil {
+			return fmt.Errorf("init %s: %w", g.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) attach(progs [2]string) error {
+	trackRx, trackTx := c.opts.TrackRx, c.opts.TrackTx
+
+	switch c.backend.Attach {
+	case "tc", "xdp":
+		var rxProg, txProg string
+		if trackRx && c.backend.Attach == "tc" {
+			rxProg = progs[0]
+		}
+		if trackTx {
+			txProg = progs[1]
+		}
+		for _, iface := range c.interfaces {
+			if trackRx && c.backend.Attach == "xdp" {
+				err := attachXdp(c.module, iface, progs[0], c.opts.Debug)
+				if err != nil {
+					return err
+				}
+			}
+
+			a, err := attachTc(c.module, iface, rxProg, txProg, c.opts.Debug)
+			if err != nil {
+				return err
+			}
+			c.closers = append(c.closers, a.detach)
+		}
+	default:
+		if trackRx {
+			err := c.attachProgram(progs[0])
+			if err != nil {
+				return err
+			}
+		}
+
+		if trackTx {
+			err := c.attachProgram(progs[1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if needRoutingClasses(c.classes) {
+		// the probes see every interface, so tell them which ones are
+		// attached
+		if c.backend.Attach == "tc" || c.backend.Attach == "xdp" {
+			err := loadIfindexes(c.module, c.interfaces)
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range routingClassPrograms {
+			err := c.attachProgram(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) attachProgram(name string) error {
+	prog, err := c.module.GetProgram(name)
+	if err != nil {
+		return err
+	}
+	if c.opts.Debug {
+		log.Printf("attaching program %q", prog.Name())
+	}
+
+	_, err = prog.AttachGeneric()
+	if err != nil {
+		return fmt.Errorf("failed to attach program (%s): %v", prog.Name(), err)
+	}
+
+	return nil
+}
+
+// Stop stops the timer and detaches the programs. Returns the error that
+// stopped the collector, if any.
+func (c *Collector) Stop() error {
+	if c.cancel == nil {
+		return errors.New("collector not started")
+	}
+	c.cancel()
+	c.wg.Wait()
+	c.close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Collector) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+	c.closers = nil
+	c.filters = nil
+
+	close(c.samples)
+	close(c.annotations)
+}
+
+// fail stops the collector with the given error, from the workers
+func (c *Collector) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	c.cancel()
+}
+
+// publish sends the window to the consumer, dropping it if the consumer
+// can't keep up
+func (c *Collector) publish(s rxTxStats) {
+	sample := Sample{
+		Time:      s.time,
+		RxBytes:   s.rxBytes,
+		TxBytes:   s.txBytes,
+		RxPackets: s.rxPackets,
+		TxPackets: s.txPackets,
+		Classes:   make([]uint64, len(c.classes)),
+	}
+	for i, class := range c.classes {
+		sample.Classes[i] = s.values[class.key]
+	}
+	if c.opts.PacketSizes {
+		sample.RxSizes = sizeHistOf(s.values, RX_SIZE_PACKETS)
+		sample.TxSizes = sizeHistOf(s.values, TX_SIZE_PACKETS)
+	}
+	if c.opts.Incast {
+		sample.Sources = linearCount(s.values[RX_SOURCES])
+		sample.Flows = linearCount(s.values[RX_FLOWS])
+	}
+
+	select {
+	case c.samples <- sample:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// Dropped is the number of windows dropped so far because the consumer
+// couldn't keep up
+func (c *Collector) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+func (c *Collector) annotate(a Annotation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+
+	select {
+	case c.annotations <- a:
+	default:
+		log.Printf("dropping annotation %q", a.Text)
+	}
+}
+
+// Annotate adds an annotation to the window series, like a failed filter
+// reload
+func (c *Collector) Annotate(text string) {
+	c.annotate(Annotation{Time: time.Now(), Text: text})
+}
+
+// getFilters is the filter state once started, nil otherwise
+func (c *Collector) getFilters() *filterState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.filters
+}
+
+// Filters are the current filters
+func (c *Collector) Filters() Filters {
+	f := c.getFilters()
+	if f == nil {
+		return c.opts.Filters
+	}
+	return f.get()
+}
+
+// SetFilters validates and applies the given filters while running, the
+// window series is annotated with the change. Returns the description of
+// the change.
+func (c *Collector) SetFilters(spec Filters) (string, error) {
+	f := c.getFilters()
+	if f == nil {
+		return "", errors.New("collector not running")
+	}
+	return f.set(spec)
+}
+
+// ApplyCommand runs a single filter command on top of the current filters:
+//
+//	interface [name]  track only the given interface, all if empty
+//	filter [expr]     track only the packets matching expr
+//	src-cidr [cidrs]  track only the packets from the cidrs
+//	dst-cidr [cidrs]  track only the packets to the cidrs
+//	port [ports]      track only the packets from or to the ports
+//	mark [value/mask] track only the packets with the skb->mark
+//	show              show the current filters
+func (c *Collector) ApplyCommand(line string) (string, error) {
+	f := c.getFilters()
+	if f == nil {
+		return "", errors.New("collector not running")
+	}
+	return f.applyCommand(line)
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,491 @@
+package microburst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// Packet filter expressions (a subset of the tcpdump/pcap-filter syntax),
+// compiled into the postfix program run by filter_match() in the bpf code.
+//
+// Supported primitives:
+//
+//	ip, ip6, tcp, udp, sctp, icmp, icmp6
+//	[src|dst] host <addr>, [src|dst] <addr>, <addr>
+//	[src|dst] net <cidr>
+//	[tcp|udp|sctp] [src|dst] port <port>
+//	[tcp|udp|sctp] [src|dst] portrange <port>-<port>
+//	dscp <codepoint>, like dscp ef or dscp 46
+//	priority <skb priority>, like priority 1:10 (tc classid) or priority 6
+//	mark <value>[/<mask>], like mark 0x100/0xff00
+//	encap <none|vxlan|geneve|gre|ipip>, vni <vni or GRE key>, with decap
+//
+// combined with and (&&), or (||), not (!) and parentheses.
+
+// Same as MAX_FILTER_INSNS in the bpf code
+const MAX_FILTER_INSNS = 32
+
+// The bpf side keeps the stack of the results in the bits of a u64
+const MAX_FILTER_STACK = 64
+
+// Same as enum filter_op in the bpf code
+type filterOp uint8
+
+const (
+	FILTER_END filterOp = iota
+	FILTER_AND
+	FILTER_OR
+	FILTER_NOT
+	FILTER_FAMILY
+	FILTER_PROTO
+	FILTER_SRC_NET
+	FILTER_DST_NET
+	FILTER_SRC_PORT
+	FILTER_DST_PORT
+	FILTER_DSCP
+	FILTER_PRIORITY
+	FILTER_MARK
+	FILTER_ENCAP
+	FILTER_VNI
+)
+
+// filterInsn is the same as struct filter_insn in the bpf code
+type filterInsn struct {
+	op     filterOp
+	arg    uint8
+	portLo uint16
+	portHi uint16
+	addr   [16]byte
+	mask   [16]byte
+}
+
+const filterInsnSize = 40
+
+func (i filterInsn) encode() []byte {
+	b := make([]byte, filterInsnSize)
+	b[0] = byte(i.op)
+	b[1] = i.arg
+	binary.LittleEndian.PutUint16(b[2:4], i.portLo)
+	binary.LittleEndian.PutUint16(b[4:6], i.portHi)
+	copy(b[8:24], i.addr[:])
+	copy(b[24:40], i.mask[:])
+	return b
+}
+
+// Same as enum encap_type in the bpf code
+var filterEncaps = map[string]uint8{
+	"none":   0,
+	"vxlan":  1,
+	"geneve": 2,
+	"gre":    3,
+	"ipip":   4,
+}
+
+var filterProtos = map[string]uint8{
+	"tcp":   6,
+	"udp":   17,
+	"sctp":  132,
+	"icmp":  1,
+	"icmp6": 58,
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+	prog   []filterInsn
+}
+
+// compileFilter compiles the filter expression, an empty expression gives
+// an empty program (i.e., no filtering)
+func compileFilter(expr string) ([]filterInsn, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+
+	if err := p.parseExpr(); err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[p.pos])
+	}
+
+	if len(p.prog) > MAX_FILTER_INSNS {
+		return nil, fmt.Errorf("filter: too complex, compiles to %d instructions (max %d)", len(p.prog), MAX_FILTER_INSNS)
+	}
+	if d := filterStackDepth(p.prog); d > MAX_FILTER_STACK {
+		return nil, fmt.Errorf("filter: too deeply nested (%d)", d)
+	}
+
+	return p.prog, nil
+}
+
+func tokenizeFilter(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||", "!"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	return strings.Fields(expr)
+}
+
+func filterStackDepth(prog []filterInsn) int {
+	depth, max := 0, 0
+	for _, insn := range prog {
+		switch insn.op {
+		case FILTER_AND, FILTER_OR:
+			depth--
+		case FILTER_NOT:
+		default:
+			depth++
+		}
+		if depth > max {
+			max = depth
+		}
+	}
+	return max
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("filter: unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) emit(insns ...filterInsn) {
+	p.prog = append(p.prog, insns...)
+}
+
+// parseExpr parses the and/or chains, like pcap-filter they have the same
+// precedence and are evaluated left to right, i.e., "a or b and c" is
+// "(a or b) and c"
+func (p *filterParser) parseExpr() error {
+	if err := p.parseUnary(); err != nil {
+		return err
+	}
+	for {
+		var op filterOp
+		switch p.peek() {
+		case "and", "&&":
+			op = FILTER_AND
+		case "or", "||":
+			op = FILTER_OR
+		default:
+			return nil
+		}
+		p.pos++
+		if err := p.parseUnary(); err != nil {
+			return err
+		}
+		p.emit(filterInsn{op: op})
+	}
+}
+
+func (p *filterParser) parseUnary() error {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		if err := p.parseUnary(); err != nil {
+			return err
+		}
+		p.emit(filterInsn{op: FILTER_NOT})
+		return nil
+	case "(":
+		p.pos++
+		if err := p.parseExpr(); err != nil {
+			return err
+		}
+		if t, err := p.next(); err != nil || t != ")" {
+			return fmt.Errorf("filter: missing )")
+		}
+		return nil
+	}
+
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case "ip":
+		p.emit(filterInsn{op: FILTER_FAMILY, arg: 4})
+		return nil
+	case "ip6":
+		p.emit(filterInsn{op: FILTER_FAMILY, arg: 6})
+		return nil
+	case "dscp":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		dscp, err := parseDscp(v)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		p.emit(filterInsn{op: FILTER_DSCP, arg: dscp})
+		return nil
+	case "priority":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		prio, err := parsePriority(v)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		insn := filterInsn{op: FILTER_PRIORITY}
+		binary.LittleEndian.PutUint32(insn.addr[:], prio)
+		p.emit(insn)
+		return nil
+	case "mark":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		mark, mask, err := parseMark(v)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		insn := filterInsn{op: FILTER_MARK}
+		binary.LittleEndian.PutUint32(insn.addr[:], mark)
+		binary.LittleEndian.PutUint32(insn.mask[:], mask)
+		p.emit(insn)
+		return nil
+	case "encap":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		encap, ok := filterEncaps[v]
+		if !ok {
+			return fmt.Errorf("filter: invalid encapsulation %q", v)
+		}
+		p.emit(filterInsn{op: FILTER_ENCAP, arg: encap})
+		return nil
+	case "vni":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		vni, err := parseVni(v)
+		if err != nil {
+			return fmt.Errorf("filter: %w", err)
+		}
+		insn := filterInsn{op: FILTER_VNI}
+		binary.LittleEndian.PutUint32(insn.addr[:], vni)
+		p.emit(insn)
+		return nil
+	}
+
+	if proto, ok := filterProtos[t]; ok {
+		p.emit(filterInsn{op: FILTER_PROTO, arg: proto})
+		// "tcp port 443" is "tcp and port 443"
+		switch p.peek() {
+		case "src", "dst", "port", "portrange":
+			if err := p.parseQualified(); err != nil {
+				return err
+			}
+			p.emit(filterInsn{op: FILTER_AND})
+		}
+		return nil
+	}
+
+	p.pos--
+	return p.parseQualified()
+}
+
+// parseQualified parses [src|dst] host/net/port/portrange
+func (p *filterParser) parseQualified() error {
+	dir := ""
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = t
+		p.pos++
+	}
+
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case "host":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		return p.emitNet(dir, v, false)
+	case "net":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		return p.emitNet(dir, v, true)
+	case "port":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		port, err := parsePort(v)
+		if err != nil {
+			return err
+		}
+		p.emitPort(dir, port, port)
+		return nil
+	case "portrange":
+		v, err := p.next()
+		if err != nil {
+			return err
+		}
+		lo, hi, ok := strings.Cut(v, "-")
+		if !ok {
+			return fmt.Errorf("filter: invalid port range %q", v)
+		}
+		portLo, err := parsePort(lo)
+		if err != nil {
+			return err
+		}
+		portHi, err := parsePort(hi)
+		if err != nil {
+			return err
+		}
+		if portLo > portHi {
+			return fmt.Errorf("filter: invalid port range %q", v)
+		}
+		p.emitPort(dir, portLo, portHi)
+		return nil
+	}
+
+	// Bare address, host is implied
+	if net.ParseIP(t) != nil {
+		return p.emitNet(dir, t, false)
+	}
+
+	return fmt.Errorf("filter: unknown primitive %q", t)
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("filter: invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+func (p *filterParser) emitNet(dir string, v string, isNet bool) error {
+	insn, err := netFilterInsn(v, isNet)
+	if err != nil {
+		return err
+	}
+
+	src, dst := insn, insn
+	src.op = FILTER_SRC_NET
+	dst.op = FILTER_DST_NET
+	p.emitDir(dir, src, dst)
+	return nil
+}
+
+func (p *filterParser) emitPort(dir string, lo, hi uint16) {
+	p.emitDir(dir,
+		filterInsn{op: FILTER_SRC_PORT, portLo: lo, portHi: hi},
+		filterInsn{op: FILTER_DST_PORT, portLo: lo, portHi: hi})
+}
+
+// emitDir emits the src or dst variant, or both or-ed when no direction is
+// given
+func (p *filterParser) emitDir(dir string, src, dst filterInsn) {
+	switch dir {
+	case "src":
+		p.emit(src)
+	case "dst":
+		p.emit(dst)
+	default:
+		p.emit(src, dst, filterInsn{op: FILTER_OR})
+	}
+}
+
+// netFilterInsn builds the address/mask part of a net instruction, IPv4
+// addresses go to the first 4 bytes
+func netFilterInsn(v string, isNet bool) (filterInsn, error) {
+	var ip net.IP
+	var mask net.IPMask
+
+	if isNet {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return filterInsn{}, fmt.Errorf("filter: invalid net %q", v)
+		}
+		ip, mask = ipNet.IP, ipNet.Mask
+	} else {
+		ip = net.ParseIP(v)
+		if ip == nil {
+			return filterInsn{}, fmt.Errorf("filter: invalid host %q", v)
+		}
+		if ip.To4() != nil {
+			mask = net.CIDRMask(32, 32)
+		} else {
+			mask = net.CIDRMask(128, 128)
+		}
+	}
+
+	var insn filterInsn
+	if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv4len {
+		insn.arg = 4
+		ip = ip4
+	} else {
+		insn.arg = 6
+		ip = ip.To16()
+	}
+	for i := range mask {
+		insn.mask[i] = mask[i]
+		insn.addr[i] = ip[i] & mask[i]
+	}
+
+	return insn, nil
+}
+
+// loadFilter writes the compiled filter program into the given half of the
+// filter_prog map, the rest of the half is cleared
+func loadFilter(module *bpf.Module, slot uint8, prog []filterInsn) error {
+	m, err := module.GetMap("filter_prog")
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < MAX_FILTER_INSNS; i++ {
+		// zero is FILTER_END
+		var insn filterInsn
+		if i < len(prog) {
+			insn = prog[i]
+		}
+
+		key := uint32(slot)*MAX_FILTER_INSNS + uint32(i)
+		value := insn.encode()
+		err = m.Update(unsafe.Pointer(&key), unsafe.Pointer(&value[0]))
+		if err != nil {
+			return fmt.Errorf("update filter_prog: %w", err)
+		}
+		if i >= len(prog) {
+			break
+		}
+	}
+
+	return nil
+}
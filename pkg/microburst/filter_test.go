@@ -0,0 +1,98 @@
+package microburst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func filterOps(prog []filterInsn) []filterOp {
+	var ops []filterOp
+	for _, insn := range prog {
+		ops = append(ops, insn.op)
+	}
+	return ops
+}
+
+func TestCompileFilter(t *testing.T) {
+	for expr, want := range map[string][]filterOp{
+		"":                         nil,
+		"tcp":                      {FILTER_PROTO},
+		"ip6":                      {FILTER_FAMILY},
+		"src port 53":              {FILTER_SRC_PORT},
+		"port 53":                  {FILTER_SRC_PORT, FILTER_DST_PORT, FILTER_OR},
+		"tcp dst port 443":         {FILTER_PROTO, FILTER_DST_PORT, FILTER_AND},
+		"10.0.0.5":                 {FILTER_SRC_NET, FILTER_DST_NET, FILTER_OR},
+		"not dst 10.0.0.5":         {FILTER_DST_NET, FILTER_NOT},
+		"udp or icmp and ip":       {FILTER_PROTO, FILTER_PROTO, FILTER_OR, FILTER_FAMILY, FILTER_AND},
+		"ip and udp or icmp":       {FILTER_FAMILY, FILTER_PROTO, FILTER_AND, FILTER_PROTO, FILTER_OR},
+		"dscp ef or priority 1:10": {FILTER_DSCP, FILTER_PRIORITY, FILTER_OR},
+		"encap vxlan and vni 42":   {FILTER_ENCAP, FILTER_VNI, FILTER_AND},
+		"(udp || icmp) && !ip6": {
+			FILTER_PROTO, FILTER_PROTO, FILTER_OR, FILTER_FAMILY, FILTER_NOT, FILTER_AND,
+		},
+	} {
+		prog, err := compileFilter(expr)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, filterOps(prog), expr)
+	}
+}
+
+func TestCompileFilterArgs(t *testing.T) {
+	prog, err := compileFilter("src net 10.1.2.3/16")
+	require.NoError(t, err)
+	require.Len(t, prog, 1)
+	require.Equal(t, uint8(4), prog[0].arg)
+	require.Equal(t, []byte{10, 1, 0, 0}, prog[0].addr[:4])
+	require.Equal(t, []byte{255, 255, 0, 0}, prog[0].mask[:4])
+
+	prog, err = compileFilter("dst host 2001:db8::1")
+	require.NoError(t, err)
+	require.Equal(t, uint8(6), prog[0].arg)
+	require.Equal(t, byte(0x20), prog[0].addr[0])
+	require.Equal(t, byte(1), prog[0].addr[15])
+	require.Equal(t, byte(0xff), prog[0].mask[15])
+
+	prog, err = compileFilter("sctp portrange 1000-2000")
+	require.NoError(t, err)
+	require.Equal(t, uint8(132), prog[0].arg)
+	require.Equal(t, uint16(1000), prog[1].portLo)
+	require.Equal(t, uint16(2000), prog[1].portHi)
+
+	b := prog[1].encode()
+	require.Len(t, b, filterInsnSize)
+	require.Equal(t, []byte{byte(FILTER_SRC_PORT), 0, 0xe8, 0x03, 0xd0, 0x07}, b[:6])
+
+	prog, err = compileFilter("dscp af41 and priority 1:10")
+	require.NoError(t, err)
+	require.Equal(t, uint8(34), prog[0].arg)
+	require.Equal(t, []byte{0x10, 0, 1, 0}, prog[1].addr[:4])
+
+	prog, err = compileFilter("not mark 0x100/0xff00")
+	require.NoError(t, err)
+	require.Equal(t, []filterOp{FILTER_MARK, FILTER_NOT}, filterOps(prog))
+	require.Equal(t, []byte{0, 1, 0, 0}, prog[0].addr[:4])
+	require.Equal(t, []byte{0, 0xff, 0, 0}, prog[0].mask[:4])
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"port http",
+		"portrange 20-10",
+		"host example.com",
+		"net 10.0.0.0",
+		"foo",
+		"dscp 64",
+		"encap mpls",
+		"vni x",
+		"dscp",
+		"priority x:1",
+		"port 1 or port 2 or port 3 or port 4 or port 5 or port 6 or port 7 or port 8 or port 9",
+	} {
+		_, err := compileFilter(expr)
+		require.Error(t, err, expr)
+	}
+}
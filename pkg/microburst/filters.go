@@ -0,0 +1,318 @@
+package microburst
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// Annotation marks a point in the window series, like a filter change
+type Annotation struct {
+	Time time.Time
+	Text string
+}
+
+// filterConfigSize is the size of struct filter_config in the bpf code
+const filterConfigSize = 32
+
+// Filters is what to track. Empty means no filtering.
+type Filters struct {
+	// Interface is the network interface to track, a comma separated
+	// list with attach tc or xdp
+	Interface string
+	// Expr is a filter expression, like "tcp port 443 and host 10.0.0.5"
+	Expr string
+	// SrcCidr and DstCidr are comma separated lists of IPv4/IPv6 CIDRs
+	SrcCidr string
+	DstCidr string
+	// Port is a comma separated list of ports or port ranges, like
+	// "443,8000-8100"
+	Port string
+	// Mark is the skb->mark as value[/mask], like "0x100/0xff00"
+	Mark string
+}
+
+// filterState is the current runtime filters, i.e., what is in the
+// filter_config, filter_prog, src_cidrs, dst_cidrs and filter_ports maps.
+// The filters can be changed while running, without reloading the bpf
+// object.
+type filterState struct {
+	mu     sync.Mutex
+	module *bpf.Module
+	slot   uint8
+	spec   Filters
+	// the interfaces are fixed with tc/xdp, they are where the programs
+	// are attached
+	attach     string
+	fixedIface bool
+	srcCidrs   map[string][]byte
+	dstCidrs   map[string][]byte
+	ports      map[uint16]bool
+	annotate   func(Annotation)
+}
+
+func newFilterState(module *bpf.Module, attach string, annotate func(Annotation)) *filterState {
+	return &filterState{
+		module:     module,
+		attach:     attach,
+		fixedIface: attach == "tc" || attach == "xdp",
+		annotate:   annotate,
+	}
+}
+
+// init applies the initial filters, given on the command line
+func (f *filterState) init(spec Filters) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.update(spec)
+}
+
+// set validates and applies the given filters, the window series is
+// annotated with the change. Returns the description of the change.
+func (f *filterState) set(spec Filters) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if spec == f.spec {
+		return "filters unchanged", nil
+	}
+
+	if spec.Interface != f.spec.Interface && f.fixedIface {
+		return "", fmt.Errorf("interface can't be changed with attach=%s", f.attach)
+	}
+
+	err := f.update(spec)
+	if err != nil {
+		return "", err
+	}
+
+	desc := fmt.Sprintf("filters changed: %s", f.spec)
+	f.annotate(Annotation{Time: time.Now(), Text: desc})
+
+	return desc, nil
+}
+
+func (f *filterState) update(spec Filters) error {
+	if !f.fixedIface {
+		if len(spec.Interface) > 16 {
+			return fmt.Errorf("network interfaces with more than 16 bytes not supported")
+		}
+		if strings.Contains(spec.Interface, ",") {
+			return fmt.Errorf("multiple network interfaces are supported only with attach=tc or attach=xdp")
+		}
+	}
+
+	prog, srcCidrs, dstCidrs, ports, err := spec.compile()
+	if err != nil {
+		return err
+	}
+	// Write the program to the inactive half first, the bpf programs
+	// switch to it once filter_config is updated
+	slot := f.slot ^ 1
+	err = loadFilter(f.module, slot, prog)
+	if err != nil {
+		return err
+	}
+
+	// The cidr and port maps aren't double buffered, they are put back
+	// if anything fails before filter_config is updated
+	err = syncCidrs(f.module, "src_cidrs", f.srcCidrs, srcCidrs)
+	if err == nil {
+		err = syncCidrs(f.module, "dst_cidrs", f.dstCidrs, dstCidrs)
+	}
+	if err == nil {
+		err = syncPorts(f.module, f.ports, ports)
+	}
+	if err == nil {
+		err = f.updateConfig(spec, prog != nil, slot, srcCidrs, dstCidrs, ports)
+	}
+	if err != nil {
+		return errors.Join(err, f.restoreMaps(srcCidrs, dstCidrs, ports))
+	}
+
+	f.srcCidrs = srcCidrs
+	f.dstCidrs = dstCidrs
+	f.ports = ports
+	f.slot = slot
+	f.spec = spec
+
+	return nil
+}
+
+// restoreMaps puts the cidr and port maps back to the current filters,
+// after a failed update to the given ones
+func (f *filterState) restoreMaps(srcCidrs, dstCidrs map[string][]byte, ports map[uint16]bool) error {
+	return errors.Join(
+		restoreCidrs(f.module, "src_cidrs", f.srcCidrs, srcCidrs),
+		restoreCidrs(f.module, "dst_cidrs", f.dstCidrs, dstCidrs),
+		// the ports are set or cleared either way, syncing back is enough
+		syncPorts(f.module, ports, f.ports),
+	)
+}
+
+// updateConfig switches the bpf programs to the new filters
+func (f *filterState) updateConfig(spec Filters, filterPkt bool, slot uint8, srcCidrs, dstCidrs map[string][]byte, ports map[uint16]bool) error {
+	var mark, markMask uint32
+	if spec.Mark != "" {
+		mark, markMask, _ = parseMark(spec.Mark)
+	}
+
+	cfg := make([]byte, filterConfigSize)
+	if spec.Interface != "" && !f.fixedIface {
+		cfg[0] = 1
+		copy(cfg[8:], spec.Interface)
+	}
+	cfg[1] = boolToUint8(filterPkt)
+	cfg[2] = slot
+	cfg[3] = boolToUint8(len(srcCidrs) > 0)
+	cfg[4] = boolToUint8(len(dstCidrs) > 0)
+	cfg[5] = boolToUint8(len(ports) > 0)
+	cfg[6] = boolToUint8(spec.Mark != "")
+	binary.LittleEndian.PutUint32(cfg[24:28], mark)
+	binary.LittleEndian.PutUint32(cfg[28:32], markMask)
+
+	m, err := f.module.GetMap("filter_config")
+	if err != nil {
+		return err
+	}
+	key := uint32(0)
+	err = m.Update(unsafe.Pointer(&key), unsafe.Pointer(&cfg[0]))
+	if err != nil {
+		return fmt.Errorf("update filter_config: %w", err)
+	}
+	return nil
+}
+
+func (f *filterState) get() Filters {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.spec
+}
+
+// compile checks the filters, returning what goes into the maps
+func (s Filters) compile() ([]filterInsn, map[string][]byte, map[string][]byte, map[uint16]bool, error) {
+	prog, err := compileFilter(s.Expr)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	srcCidrs, err := parseCidrs(s.SrcCidr)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("src-cidr: %w", err)
+	}
+	dstCidrs, err := parseCidrs(s.DstCidr)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("dst-cidr: %w", err)
+	}
+	ports, err := parsePorts(s.Port)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("port: %w", err)
+	}
+	if s.Mark != "" {
+		if _, _, err := parseMark(s.Mark); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("mark: %w", err)
+		}
+	}
+	return prog, srcCidrs, dstCidrs, ports, nil
+}
+
+func (s Filters) String() string {
+	iface := s.Interface
+	if iface == "" {
+		iface = "all"
+	}
+
+	desc := fmt.Sprintf("interface=%s", iface)
+	if s.SrcCidr != "" {
+		desc += fmt.Sprintf(" src-cidr=%s", s.SrcCidr)
+	}
+	if s.DstCidr != "" {
+		desc += fmt.Sprintf(" dst-cidr=%s", s.DstCidr)
+	}
+	if s.Port != "" {
+		desc += fmt.Sprintf(" port=%s", s.Port)
+	}
+	if s.Mark != "" {
+		desc += fmt.Sprintf(" mark=%s", s.Mark)
+	}
+	if s.Expr != "" {
+		desc += fmt.Sprintf(" filter=%q", s.Expr)
+	}
+	return desc
+}
+
+// Set sets the filter for the given command (interface, filter, src-cidr,
+// dst-cidr, port or mark), false if there is no such command
+func (s *Filters) Set(cmd string, arg string) bool {
+	switch cmd {
+	case "interface":
+		s.Interface = arg
+	case "filter":
+		s.Expr = arg
+	case "src-cidr":
+		s.SrcCidr = arg
+	case "dst-cidr":
+		s.DstCidr = arg
+	case "port":
+		s.Port = arg
+	case "mark":
+		s.Mark = arg
+	default:
+		return false
+	}
+	return true
+}
+
+// applyCommand runs a single filter command, see Collector.ApplyCommand
+func (f *filterState) applyCommand(line string) (string, error) {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	arg = strings.TrimSpace(arg)
+
+	if cmd == "show" {
+		return f.get().String(), nil
+	}
+
+	spec := f.get()
+	if !spec.Set(cmd, arg) {
+		return "", fmt.Errorf("unknown command %q", cmd)
+	}
+	return f.set(spec)
+}
+
+// ReadFilterFile reads the filters from the file, which has the same
+// commands as ApplyCommand (other than show), one per line. The ones not in
+// the file are left as in spec.
+func ReadFilterFile(path string, spec Filters) (Filters, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return spec, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		if !spec.Set(cmd, strings.TrimSpace(arg)) {
+			return spec, fmt.Errorf("%s: unknown command %q", path, cmd)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return spec, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return spec, nil
+}
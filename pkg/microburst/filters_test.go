@@ -0,0 +1,34 @@
+package microburst
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFilterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters")
+	spec := Filters{Interface: "eth0", Expr: "udp"}
+
+	err := os.WriteFile(path, []byte("# comment\n\nfilter tcp port 443 and host 10.0.0.5\ndst-cidr 10.0.0.0/8, fd00::/8\n"), 0o644)
+	require.NoError(t, err)
+
+	got, err := ReadFilterFile(path, spec)
+	require.NoError(t, err)
+	require.Equal(t, Filters{Interface: "eth0", Expr: "tcp port 443 and host 10.0.0.5", DstCidr: "10.0.0.0/8, fd00::/8"}, got)
+
+	err = os.WriteFile(path, []byte("interface\nfilter\n"), 0o644)
+	require.NoError(t, err)
+
+	got, err = ReadFilterFile(path, spec)
+	require.NoError(t, err)
+	require.Equal(t, Filters{}, got)
+
+	err = os.WriteFile(path, []byte("iface eth1\n"), 0o644)
+	require.NoError(t, err)
+
+	_, err = ReadFilterFile(path, spec)
+	require.Error(t, err)
+}
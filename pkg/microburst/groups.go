@@ -0,0 +1,230 @@
+package microburst
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// Same as MAX_GROUPS in the bpf code
+const MAX_GROUPS = 8
+
+// Same as enum group_kind in the bpf code
+const (
+	GROUP_DSCP = iota
+	GROUP_PRIORITY
+	GROUP_MARK
+	GROUP_VNI
+)
+
+// group is a value of a packet field (like DSCP) whose bytes are tracked
+// as separate rx and tx series. Each group gets a slot, i.e., one of the
+// MAX_GROUPS rx and tx counters.
+type group struct {
+	kind  uint32
+	value uint32
+	label string
+}
+
+// dscpNames are the names of the standard DSCP codepoints
+var dscpNames = map[string]uint8{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+// parseDscp parses a DSCP codepoint, either a name (like ef or af41) or a
+// number
+func parseDscp(s string) (uint8, error) {
+	if v, ok := dscpNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return uint8(v), nil
+}
+
+// parsePriority parses a skb->priority, either as a tc classid (like 1:10,
+// hex as in tc) or a number
+func parsePriority(s string) (uint32, error) {
+	if major, minor, ok := strings.Cut(s, ":"); ok {
+		maj, err := strconv.ParseUint(major, 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid classid %q", s)
+		}
+		var min uint64
+		if minor != "" {
+			min, err = strconv.ParseUint(minor, 16, 16)
+			if err != nil {
+				return 0, fmt.Errorf("invalid classid %q", s)
+			}
+		}
+		return uint32(maj<<16 | min), nil
+	}
+
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority %q", s)
+	}
+	return uint32(v), nil
+}
+
+// parseMark parses a skb->mark with an optional mask, like 0x100/0xff00.
+// The mask is all ones if not given.
+func parseMark(s string) (uint32, uint32, error) {
+	value, mask, hasMask := strings.Cut(s, "/")
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mark %q", s)
+	}
+
+	m := uint64(0xffffffff)
+	if hasMask {
+		m, err = strconv.ParseUint(mask, 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid mark mask %q", s)
+		}
+	}
+
+	return uint32(v & m), uint32(m), nil
+}
+
+// parseVni parses a VXLAN/Geneve VNI or a GRE key
+func parseVni(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vni %q", s)
+	}
+	return uint32(v), nil
+}
+
+// parseGroups parses the comma separated lists of DSCP codepoints,
+// priorities, marks and VNIs to track. The marks share a single mask, which
+// is returned as well.
+func parseGroups(dscps string, priorities string, marks string, vnis string) ([]group, uint32, error) {
+	var groups []group
+	seen := make(map[group]bool)
+
+	add := func(g group) {
+		key := group{kind: g.kind, value: g.value}
+		if !seen[key] {
+			groups = append(groups, g)
+			seen[key] = true
+		}
+	}
+
+	for _, v := range strings.Split(dscps, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		dscp, err := parseDscp(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		add(group{kind: GROUP_DSCP, value: uint32(dscp), label: "dscp " + v})
+	}
+
+	for _, v := range strings.Split(priorities, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		prio, err := parsePriority(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		add(group{kind: GROUP_PRIORITY, value: prio, label: "priority " + v})
+	}
+
+	markMask := uint32(0xffffffff)
+	hasMarks := false
+	for _, v := range strings.Split(marks, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		mark, mask, err := parseMark(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		if hasMarks && mask != markMask {
+			return nil, 0, fmt.Errorf("mark groups with different masks %q", marks)
+		}
+		markMask = mask
+		hasMarks = true
+		add(group{kind: GROUP_MARK, value: mark, label: fmt.Sprintf("mark %#x", mark)})
+	}
+
+	for _, v := range strings.Split(vnis, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		vni, err := parseVni(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		add(group{kind: GROUP_VNI, value: vni, label: "vni " + v})
+	}
+
+	if len(groups) > MAX_GROUPS {
+		return nil, 0, fmt.Errorf("too many groups %d (max %d)", len(groups), MAX_GROUPS)
+	}
+
+	return groups, markMask, nil
+}
+
+// groupClasses are the series of the groups. The marks are tracked only on
+// transmit, the received packets are not marked yet where they are
+// accounted.
+func groupClasses(groups []group, rx bool, tx bool) []Class {
+	var classes []Class
+	for slot, g := range groups {
+		name := strings.ReplaceAll(g.label, " ", "=")
+		if rx && g.kind != GROUP_MARK {
+			classes = append(classes, Class{"rx:" + name, "Received " + g.label, GROUP_RX_BYTES + slot})
+		}
+		if tx {
+			classes = append(classes, Class{"tx:" + name, "Transmitted " + g.label, GROUP_TX_BYTES + slot})
+		}
+	}
+	return classes
+}
+
+// groupKinds is the group_kinds bitmask of the bpf code
+func groupKinds(groups []group) uint32 {
+	var kinds uint32
+	for _, g := range groups {
+		kinds |= 1 << g.kind
+	}
+	return kinds
+}
+
+// loadGroups assigns the slots of the groups in the group_slots map
+func loadGroups(module *bpf.Module, groups []group) error {
+	m, err := module.GetMap("group_slots")
+	if err != nil {
+		return err
+	}
+
+	for slot, g := range groups {
+		key := [2]uint32{g.kind, g.value}
+		value := uint32(slot)
+		err = m.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value))
+		if err != nil {
+			return fmt.Errorf("update group_slots: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package microburst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGroups(t *testing.T) {
+	g, mask, err := parseGroups("ef, af41,46,0x0", "1:10,6,1:", "", "")
+	require.NoError(t, err)
+	require.Equal(t, []group{
+		{GROUP_DSCP, 46, "dscp ef"},
+		{GROUP_DSCP, 34, "dscp af41"},
+		{GROUP_DSCP, 0, "dscp 0x0"},
+		{GROUP_PRIORITY, 0x10010, "priority 1:10"},
+		{GROUP_PRIORITY, 6, "priority 6"},
+		{GROUP_PRIORITY, 0x10000, "priority 1:"},
+	}, g)
+	require.Equal(t, uint32(0xffffffff), mask)
+	require.Equal(t, uint32(1<<GROUP_DSCP|1<<GROUP_PRIORITY), groupKinds(g))
+
+	c := groupClasses(g[:2], true, false)
+	require.Len(t, c, 2)
+	require.Equal(t, GROUP_RX_BYTES+1, c[1].key)
+	require.Equal(t, "Received dscp af41", c[1].Title)
+
+	c = groupClasses(g[:2], true, true)
+	require.Len(t, c, 4)
+	require.Equal(t, GROUP_TX_BYTES, c[1].key)
+
+	g, mask, err = parseGroups("", "", "0x100/0xff00, 0x2ff/0xff00,0x1ff/0xff00", "42")
+	require.NoError(t, err)
+	require.Equal(t, []group{
+		{GROUP_MARK, 0x100, "mark 0x100"},
+		{GROUP_MARK, 0x200, "mark 0x200"},
+		{GROUP_VNI, 42, "vni 42"},
+	}, g)
+	require.Equal(t, uint32(0xff00), mask)
+	require.Equal(t, uint32(1<<GROUP_MARK|1<<GROUP_VNI), groupKinds(g))
+
+	// the marks are tracked only on transmit
+	c = groupClasses(g, true, true)
+	require.Len(t, c, 4)
+	require.Equal(t, "tx:mark=0x100", c[0].Name)
+	require.Equal(t, "rx:vni=42", c[2].Name)
+
+	g, _, err = parseGroups("", "", "", "")
+	require.NoError(t, err)
+	require.Empty(t, g)
+	require.Zero(t, groupKinds(g))
+
+	for _, v := range [][4]string{
+		{"64", "", "", ""},
+		{"xx", "", "", ""},
+		{"", "1:10000", "", ""},
+		{"", "foo", "", ""},
+		{"", "", "0x1/0xff,0x2", ""},
+		{"", "", "0x1/x", ""},
+		{"", "", "", "-1"},
+		{"0,1,2,3,4,5,6", "", "8", "9"},
+	} {
+		_, _, err = parseGroups(v[0], v[1], v[2], v[3])
+		require.Error(t, err, v)
+	}
+}
+
+func TestParseMark(t *testing.T) {
+	mark, mask, err := parseMark("0x100/0xff00")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0x100), mark)
+	require.Equal(t, uint32(0xff00), mask)
+
+	mark, mask, err = parseMark("42")
+	require.NoError(t, err)
+	require.Equal(t, uint32(42), mark)
+	require.Equal(t, uint32(0xffffffff), mask)
+
+	_, _, err = parseMark("0x100000000")
+	require.Error(t, err)
+}
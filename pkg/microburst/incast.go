@@ -0,0 +1,24 @@
+package microburst
+
+import (
+	"math"
+)
+
+// Bits of each incast bitmap, same as INCAST_BITMAP_WORDS * 64 in the bpf
+// code
+const INCAST_BITMAP_BITS = 64 * 64
+
+// linearCount estimates the number of distinct items that set the given
+// number of bits of the incast bitmap
+func linearCount(setBits uint64) uint64 {
+	if setBits == 0 {
+		return 0
+	}
+
+	// Saturated, it is at least this many
+	zero := float64(INCAST_BITMAP_BITS - setBits)
+	if zero < 1 {
+		zero = 1
+	}
+	return uint64(math.Round(-INCAST_BITMAP_BITS * math.Log(zero/INCAST_BITMAP_BITS)))
+}
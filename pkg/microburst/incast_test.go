@@ -0,0 +1,77 @@
+package microburst
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinearCount(t *testing.T) {
+	require.Equal(t, uint64(0), linearCount(0))
+	require.Equal(t, uint64(1), linearCount(1))
+	// few collisions while the bitmap is sparse
+	require.InDelta(t, 100, float64(linearCount(99)), 1)
+	// -m ln(1/2) for a half full bitmap
+	require.Equal(t, uint64(2839), linearCount(INCAST_BITMAP_BITS/2))
+	// saturated
+	require.Equal(t, linearCount(INCAST_BITMAP_BITS-1), linearCount(INCAST_BITMAP_BITS))
+}
+
+// TestIncastWindowBoundary checks that the incast bitmaps are reset when the
+// window is collected, and only then
+func TestIncastWindowBoundary(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to load the bpf programs")
+	}
+	if len(defaultBpfBin) == 0 {
+		t.Skip("the bpf objects are not built")
+	}
+
+	opts := DefaultOptions()
+	// the windows are advanced by the test instead
+	opts.Window = time.Hour
+	opts.Timer = "perf"
+	opts.Attach = "tc"
+	opts.Filters.Interface = "lo"
+	opts.Incast = true
+	c, err := New(opts)
+	require.NoError(t, err)
+	if err := c.Start(context.Background()); err != nil {
+		t.Skipf("can't start the collector: %v", err)
+	}
+	defer c.Stop()
+
+	prog, err := c.module.GetProgram("tc_network_receive")
+	require.NoError(t, err)
+	txrxInfo, err := c.module.GetMap("txrx_info")
+	require.NoError(t, err)
+	incastWindow, err := c.module.GetMap("incast_window")
+	require.NoError(t, err)
+
+	// ethernet, ipv4 10.0.0.1 -> 10.0.0.2 and udp 1000 -> 53
+	pkt := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(pkt[12:], 0x0800)
+	copy(pkt[14:], []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2})
+	binary.BigEndian.PutUint16(pkt[34:], 1000)
+	binary.BigEndian.PutUint16(pkt[36:], 53)
+	sources := func() uint64 {
+		counters, err := c.getCounterValues(txrxInfo)
+		require.NoError(t, err)
+		return counters[RX_SOURCES]
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, runBpfProg(prog.FileDescriptor(), pkt))
+	}
+	require.Equal(t, uint64(1), sources())
+
+	// the same source is counted again in the next window
+	require.NoError(t, nextIncastWindow(incastWindow))
+	require.NoError(t, runBpfProg(prog.FileDescriptor(), pkt))
+	require.NoError(t, runBpfProg(prog.FileDescriptor(), pkt))
+	require.Equal(t, uint64(2), sources())
+}
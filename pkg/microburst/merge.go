@@ -0,0 +1,113 @@
+package microburst
+
+import (
+	"sort"
+	"time"
+)
+
+// How many windows we wait for the slower cpus before publishing a window
+// that not all the cpus have reported yet
+const MERGE_MAX_LAG_WINDOWS = 4
+
+// Upper bound on the empty windows we fill in for a gap, so that a
+// (very) late sample doesn't make us flood the consumers
+const MERGE_MAX_GAP_WINDOWS = 1000
+
+// cpuStats is the bytes transferred on a single cpu since its previous
+// sample, as reported by calc_local_metrics
+type cpuStats struct {
+	cpu    uint32
+	ts     uint64 // ns since boot
+	values [NR_COUNTERS]uint64
+}
+
+type mergedWindow struct {
+	values [NR_COUNTERS]uint64
+	cpus   map[uint32]struct{}
+}
+
+// windowMerger merges the per cpu samples into windows aligned to the
+// burst window. The per cpu timers are not in phase with each other, so a
+// sample is accounted in the window its timestamp falls into.
+type windowMerger struct {
+	window  uint64
+	numCpus int
+	base    time.Time
+	pending map[uint64]*mergedWindow
+	newest  uint64
+	// next window to be published, valid only if started is set
+	next    uint64
+	started bool
+}
+
+// newWindowMerger creates a merger for samples from numCpus cpus, the
+// sample timestamps are relative to base (i.e., boot time)
+func newWindowMerger(window time.Duration, numCpus int, base time.Time) *windowMerger {
+	return &windowMerger{
+		window:  uint64(window.Nanoseconds()),
+		numCpus: numCpus,
+		base:    base,
+		pending: make(map[uint64]*mergedWindow),
+	}
+}
+
+// add accounts the given sample and returns the windows that are complete
+// (in order). The returned stats have the time set to the end of the
+// window.
+func (m *windowMerger) add(s cpuStats) []rxTxStats {
+	idx := s.ts / m.window
+	if m.started && idx < m.next {
+		// The window has been published already, account it in the
+		// next one instead of losing the bytes
+		idx = m.next
+	}
+	if idx > m.newest {
+		m.newest = idx
+	}
+
+	w, ok := m.pending[idx]
+	if !ok {
+		w = &mergedWindow{cpus: make(map[uint32]struct{})}
+		m.pending[idx] = w
+	}
+	for i, v := range s.values {
+		w.values[i] += v
+	}
+	w.cpus[s.cpu] = struct{}{}
+
+	return m.flush()
+}
+
+func (m *windowMerger) flush() []rxTxStats {
+	var res []rxTxStats
+
+	keys := make([]uint64, 0, len(m.pending))
+	for k := range m.pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, idx := range keys {
+		w := m.pending[idx]
+		if len(w.cpus) < m.numCpus && idx+MERGE_MAX_LAG_WINDOWS > m.newest {
+			break
+		}
+
+		if m.started && idx > m.next && idx-m.next <= MERGE_MAX_GAP_WINDOWS {
+			for i := m.next; i < idx; i++ {
+				res = append(res, rxTxStats{time: m.windowEnd(i)})
+			}
+		}
+
+		res = append(res, newRxTxStats(m.windowEnd(idx), w.values))
+		delete(m.pending, idx)
+		m.next = idx + 1
+		m.started = true
+	}
+
+	return res
+}
+
+func (m *windowMerger) windowEnd(idx uint64) time.Time {
+	return m.base.Add(time.Duration((idx + 1) * m.window))
+}
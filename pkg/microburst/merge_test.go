@@ -0,0 +1,33 @@
+package microburst
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowMerger(t *testing.T) {
+	base := time.Unix(1000, 0)
+	m := newWindowMerger(time.Millisecond, 2, base)
+	ms := uint64(time.Millisecond)
+
+	// window 1 is published only once both cpus reported it
+	require.Empty(t, m.add(cpuStats{cpu: 0, ts: 1*ms + 100, values: [NR_COUNTERS]uint64{RX_BYTES: 10, TX_BYTES: 1, RX_PACKETS: 1}}))
+	res := m.add(cpuStats{cpu: 1, ts: 1*ms + 900, values: [NR_COUNTERS]uint64{RX_BYTES: 20, TX_BYTES: 2, RX_PACKETS: 2}})
+	require.Equal(t, []rxTxStats{newRxTxStats(base.Add(2*time.Millisecond), [NR_COUNTERS]uint64{RX_BYTES: 30, TX_BYTES: 3, RX_PACKETS: 3})}, res)
+
+	// late sample for an already published window goes to the next one
+	require.Empty(t, m.add(cpuStats{cpu: 0, ts: 1*ms + 950, values: [NR_COUNTERS]uint64{RX_BYTES: 5}}))
+	res = m.add(cpuStats{cpu: 1, ts: 2*ms + 10, values: [NR_COUNTERS]uint64{RX_BYTES: 5}})
+	require.Equal(t, []rxTxStats{newRxTxStats(base.Add(3*time.Millisecond), [NR_COUNTERS]uint64{RX_BYTES: 10})}, res)
+
+	// a silent cpu holds the window back for MERGE_MAX_LAG_WINDOWS only,
+	// and the gap is filled with empty windows
+	require.Empty(t, m.add(cpuStats{cpu: 0, ts: 4*ms + 1, values: [NR_COUNTERS]uint64{RX_BYTES: 7}}))
+	res = m.add(cpuStats{cpu: 0, ts: (4+MERGE_MAX_LAG_WINDOWS)*ms + 1, values: [NR_COUNTERS]uint64{RX_BYTES: 1}})
+	require.Equal(t, []rxTxStats{
+		newRxTxStats(base.Add(4*time.Millisecond), [NR_COUNTERS]uint64{}),
+		newRxTxStats(base.Add(5*time.Millisecond), [NR_COUNTERS]uint64{RX_BYTES: 7}),
+	}, res)
+}
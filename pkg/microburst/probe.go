@@ -0,0 +1,230 @@
+package microburst
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"golang.org/x/sys/unix"
+)
+
+// Helper ids from enum bpf_func_id (include/uapi/linux/bpf.h)
+const (
+	BPF_FUNC_TIMER_INIT             = 169
+	BPF_FUNC_MAP_LOOKUP_PERCPU_ELEM = 195
+)
+
+// features is what the running kernel supports, as far as this tool is
+// concerned
+type features struct {
+	btf          bool
+	tpBtf        bool
+	ringbuf      bool
+	percpuLookup bool
+	bpfTimer     bool
+	rawTp        bool
+	kprobe       bool
+}
+
+func probeFeatures() features {
+	var f features
+
+	_, err := os.Stat(KERNEL_BTF_PATH)
+	f.btf = err == nil
+
+	// tp_btf programs are BPF_PROG_TYPE_TRACING, which can only be
+	// attached when we have kernel BTF
+	ok, _ := bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeTracing)
+	f.tpBtf = ok && f.btf
+
+	f.rawTp, _ = bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeRawTracepoint)
+	f.kprobe, _ = bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeKprobe)
+
+	f.ringbuf, _ = bpf.BPFMapTypeIsSupported(bpf.MapTypeRingbuf)
+
+	f.percpuLookup = probeHelper(unix.BPF_PROG_TYPE_PERF_EVENT, BPF_FUNC_MAP_LOOKUP_PERCPU_ELEM, 0)
+
+	// bpf timer is armed from a syscall program, probe the helper from
+	// the same (sleepable) program type
+	ok, _ = bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeSyscall)
+	f.bpfTimer = ok && probeHelper(unix.BPF_PROG_TYPE_SYSCALL, BPF_FUNC_TIMER_INIT, unix.BPF_F_SLEEPABLE)
+
+	return f
+}
+
+func (f features) String() string {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+
+	return fmt.Sprintf("btf=%s tp_btf=%s raw_tp=%s kprobe=%s ringbuf=%s percpu_lookup=%s bpf_timer=%s",
+		yesNo(f.btf), yesNo(f.tpBtf), yesNo(f.rawTp), yesNo(f.kprobe), yesNo(f.ringbuf), yesNo(f.percpuLookup), yesNo(f.bpfTimer))
+}
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfProgLoadAttr is the prefix of the prog load struct of union bpf_attr
+// that we need, the kernel treats the rest as zero
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+// probeHelper checks if the given helper is available for the program
+// type. Same as libbpf_probe_bpf_helper(): load a program calling the
+// helper and check if the verifier complains about the helper itself. Any
+// other failure (like bad arguments) means the helper is known.
+func probeHelper(progType uint32, helper int32, progFlags uint32) bool {
+	insns := []bpfInsn{
+		{code: unix.BPF_JMP | unix.BPF_CALL, imm: helper},
+		{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K},
+		{code: unix.BPF_JMP | unix.BPF_EXIT},
+	}
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 4096)
+
+	attr := bpfProgLoadAttr{
+		progType:  progType,
+		progFlags: progFlags,
+		insnCnt:   uint32(len(insns)),
+		insns:     uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:   uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:  1,
+		logSize:   uint32(len(logBuf)),
+		logBuf:    uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno == 0 {
+		unix.Close(int(fd))
+		return true
+	}
+
+	msg := string(logBuf[:bytes.IndexByte(logBuf, 0)])
+	if msg == "" {
+		// Verifier didn't run, i.e., program type itself is not
+		// supported or we are not allowed to load programs
+		return false
+	}
+
+	return !strings.Contains(msg, "invalid func ") && !strings.Contains(msg, "unknown func ")
+}
+
+// chooseBackend picks the timer and bpf object to use based on the
+// probed features. timer is what the user asked for, "auto" picks the
+// best available one. Returns the reason for the choice, to be shown to
+// the user.
+func chooseBackend(f features, timer string) (string, []byte, string, string) {
+	switch timer {
+	case "auto":
+		if f.bpfTimer && f.percpuLookup && f.ringbuf {
+			return "bpf", defaultBpfBin, defaultBpfName, "bpf_timer, bpf_map_lookup_percpu_elem and ringbuf available"
+		}
+		if f.percpuLookup && f.ringbuf {
+			return "perf", defaultBpfBin, defaultBpfName, "bpf_map_lookup_percpu_elem and ringbuf available"
+		}
+		if f.ringbuf {
+			return "perf-percpu", userspaceTimerBpfBin, userspaceTimerBpfName, "bpf_map_lookup_percpu_elem not available, summing per cpu timers in userspace"
+		}
+		return "go", userspaceTimerBpfBin, userspaceTimerBpfName, "ringbuf not available"
+	case "perf":
+		if f.percpuLookup && f.ringbuf {
+			return "perf", defaultBpfBin, defaultBpfName, "requested"
+		}
+		fallback, bin, name, _ := chooseBackend(f, "auto")
+		return fallback, bin, name, "perf timer needs bpf_map_lookup_percpu_elem and ringbuf"
+	case "bpf":
+		if f.bpfTimer && f.percpuLookup && f.ringbuf {
+			return "bpf", defaultBpfBin, defaultBpfName, "requested"
+		}
+		fallback, bin, name, _ := chooseBackend(f, "auto")
+		return fallback, bin, name, "bpf timer needs bpf_timer, bpf_map_lookup_percpu_elem and ringbuf"
+	case "perf-percpu":
+		if f.ringbuf {
+			return "perf-percpu", userspaceTimerBpfBin, userspaceTimerBpfName, "requested"
+		}
+		return "go", userspaceTimerBpfBin, userspaceTimerBpfName, "per cpu perf timer needs ringbuf"
+	default:
+		// go timer works everywhere, anything else is rejected later
+		return timer, userspaceTimerBpfBin, userspaceTimerBpfName, "requested"
+	}
+}
+
+// attachPrograms are the rx and tx programs for each attach mode
+var attachPrograms = map[string][2]string{
+	"tp_btf": {"trace_network_receive", "trace_network_transmit"},
+	"raw_tp": {"raw_trace_network_receive", "raw_trace_network_transmit"},
+	"kprobe": {"kprobe_network_receive", "kprobe_network_transmit"},
+	"tc":     {"tc_network_receive", "tc_network_transmit"},
+	"xdp":    {"xdp_network_receive", "tc_network_transmit"},
+}
+
+// chooseAttach picks how to hook into the network stack. attach is what
+// the user asked for, "auto" picks the best available one. btfPath is the
+// external BTF, if any: raw_tp and kprobe read the sk_buff with CO-RE, so
+// they need either that or the kernel BTF.
+func chooseAttach(f features, attach string, btfPath string) (string, error) {
+	haveBtf := f.btf || btfPath != ""
+	noBtf := fmt.Errorf("attach=%s needs the kernel BTF (%s) or an external one given by btf-path or btf-dir", attach, KERNEL_BTF_PATH)
+
+	switch attach {
+	case "auto":
+		if f.tpBtf {
+			return "tp_btf", nil
+		}
+		if (f.rawTp || f.kprobe) && !haveBtf {
+			return "", fmt.Errorf("the kernel has no BTF (%s), raw_tp and kprobe need an external one given by btf-path or btf-dir", KERNEL_BTF_PATH)
+		}
+		if f.rawTp {
+			return "raw_tp", nil
+		}
+		if f.kprobe {
+			return "kprobe", nil
+		}
+		return "", fmt.Errorf("none of tp_btf, raw_tp or kprobe programs are supported by the kernel")
+	case "raw_tp", "kprobe":
+		if !haveBtf {
+			return "", noBtf
+		}
+		return attach, nil
+	case "tp_btf", "tc", "xdp":
+		return attach, nil
+	default:
+		return "", fmt.Errorf("invalid attach option %q", attach)
+	}
+}
+
+// kprobeRxTakesPskb tells if __netif_receive_skb_core() takes struct
+// sk_buff ** (since 5.7, and backported to some stable kernels), by its
+// prototype in the BTF at btfPath
+func kprobeRxTakesPskb(btfPath string) (bool, error) {
+	types, err := readBtf(btfPath)
+	if err != nil {
+		return false, err
+	}
+
+	depth, err := btfParamPointerDepth(types, "__netif_receive_skb_core", 0)
+	if err != nil {
+		return false, fmt.Errorf("can't tell the __netif_receive_skb_core signature from %s: %w", btfPath, err)
+	}
+
+	return depth == 2, nil
+}
@@ -0,0 +1,116 @@
+package microburst
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeBtf writes a BTF file with struct sk_buff and the given prototype of
+// __netif_receive_skb_core, its first parameter being pointers pointers
+// deep (through a const)
+func writeBtf(t *testing.T, pointers int) string {
+	strs := []byte("\x00sk_buff\x00__netif_receive_skb_core\x00skb\x00")
+	var types []byte
+	add := func(name uint32, kind uint32, vlen uint32, ref uint32, extra ...uint32) {
+		for _, v := range append([]uint32{name, kind<<24 | vlen, ref}, extra...) {
+			types = binary.LittleEndian.AppendUint32(types, v)
+		}
+	}
+
+	// 1: struct sk_buff, 2: const struct sk_buff
+	add(1, BTF_KIND_STRUCT, 0, 0)
+	add(0, BTF_KIND_CONST, 0, 1)
+	id := uint32(2)
+	for i := 0; i < pointers; i++ {
+		add(0, BTF_KIND_PTR, 0, id)
+		id++
+	}
+	add(0, BTF_KIND_FUNC_PROTO, 2, 0, 34, id, 0, id)
+	add(9, BTF_KIND_FUNC, 0, id+1)
+
+	hdr := []uint32{0, 24, 0, uint32(len(types)), uint32(len(types)), uint32(len(strs))}
+	b := binary.LittleEndian.AppendUint16(nil, BTF_MAGIC)
+	b = append(b, 1, 0)
+	for _, v := range hdr[1:] {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	b = append(append(b, types...), strs...)
+
+	path := filepath.Join(t.TempDir(), "vmlinux")
+	require.NoError(t, os.WriteFile(path, b, 0o644))
+	return path
+}
+
+func TestKprobeRxTakesPskb(t *testing.T) {
+	for pointers, want := range map[int]bool{1: false, 2: true} {
+		pskb, err := kprobeRxTakesPskb(writeBtf(t, pointers))
+		require.NoError(t, err)
+		require.Equal(t, want, pskb, pointers)
+	}
+
+	// the running kernel, if it has BTF
+	if _, err := os.Stat(KERNEL_BTF_PATH); err == nil {
+		_, err := kprobeRxTakesPskb(KERNEL_BTF_PATH)
+		require.NoError(t, err)
+	}
+
+	_, err := kprobeRxTakesPskb(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestBtfParamPointerDepthCycle(t *testing.T) {
+	// 1: const -> 2: typedef -> 1, and a function taking 1
+	types := []btfType{
+		{},
+		{kind: BTF_KIND_CONST, ref: 2},
+		{kind: BTF_KIND_TYPEDEF, ref: 1},
+		{kind: BTF_KIND_FUNC_PROTO, params: []uint32{1}},
+		{name: "f", kind: BTF_KIND_FUNC, ref: 3},
+	}
+	_, err := btfParamPointerDepth(types, "f", 0)
+	require.ErrorContains(t, err, "type chain")
+}
+
+func TestChooseAttach(t *testing.T) {
+	noBtf := features{rawTp: true, kprobe: true}
+	_, err := chooseAttach(noBtf, "auto", "")
+	require.ErrorContains(t, err, "btf-path")
+	_, err = chooseAttach(noBtf, "kprobe", "")
+	require.ErrorContains(t, err, "btf-path")
+
+	attach, err := chooseAttach(noBtf, "auto", "/opt/btf/5.4.0.btf")
+	require.NoError(t, err)
+	require.Equal(t, "raw_tp", attach)
+
+	attach, err = chooseAttach(features{btf: true, tpBtf: true}, "auto", "")
+	require.NoError(t, err)
+	require.Equal(t, "tp_btf", attach)
+
+	// tc and xdp work without BTF
+	attach, err = chooseAttach(noBtf, "tc", "")
+	require.NoError(t, err)
+	require.Equal(t, "tc", attach)
+}
+
+func TestChooseBackend(t *testing.T) {
+	all := features{ringbuf: true, percpuLookup: true, bpfTimer: true}
+	for timer, want := range map[string]string{"auto": "bpf", "perf": "perf", "bpf": "bpf", "go": "go"} {
+		got, _, _, _ := chooseBackend(all, timer)
+		require.Equal(t, want, got, timer)
+	}
+
+	noTimer := features{ringbuf: true, percpuLookup: true}
+	for timer, want := range map[string]string{"auto": "perf", "bpf": "perf"} {
+		got, _, _, _ := chooseBackend(noTimer, timer)
+		require.Equal(t, want, got, timer)
+	}
+
+	got, _, _, _ := chooseBackend(features{ringbuf: true}, "auto")
+	require.Equal(t, "perf-percpu", got)
+	got, _, _, _ = chooseBackend(features{}, "auto")
+	require.Equal(t, "go", got)
+}
@@ -0,0 +1,489 @@
+package microburst
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aquasecurity/libbpfgo/helpers"
+)
+
+// The recordings start with RECORDING_MAGIC and the version, followed by a
+// gzip stream of the JSON session and the records
+const (
+	RECORDING_MAGIC   = "MBR\x00"
+	RECORDING_VERSION = 1
+)
+
+// The record types
+const (
+	RECORD_SAMPLE     = 's'
+	RECORD_ANNOTATION = 'a'
+)
+
+// Session is the metadata of a recording
+type Session struct {
+	Host   string
+	Kernel string
+	// Interface is the filter-interface, empty if all the interfaces are
+	// tracked
+	Interface string
+	// Interfaces are the tracked interfaces, all of them if not filtered
+	Interfaces []string
+	Window     time.Duration
+	Timer      string
+	Attach     string
+	Accounting string
+	// Filters are the filters at the start, the changes are annotations
+	Filters     string
+	TrackRx     bool
+	TrackTx     bool
+	PacketSizes bool
+	Incast      bool
+	Classes     []Class
+	// Start is when the recording started
+	Start time.Time
+}
+
+// NewSession is the session of the given options on this host, the timer
+// and attach are left to the caller
+func NewSession(opts Options, classes []Class) Session {
+	s := Session{
+		Window:      opts.Window,
+		Accounting:  opts.Accounting,
+		Interface:   opts.Filters.Interface,
+		Filters:     opts.Filters.String(),
+		TrackRx:     opts.TrackRx,
+		TrackTx:     opts.TrackTx,
+		PacketSizes: opts.PacketSizes,
+		Incast:      opts.Incast,
+		Classes:     classes,
+		Start:       time.Now(),
+	}
+	s.Host, _ = os.Hostname()
+	s.Kernel, _ = helpers.UnameRelease()
+
+	if opts.Filters.Interface != "" {
+		s.Interfaces = strings.Split(opts.Filters.Interface, ",")
+	} else if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			s.Interfaces = append(s.Interfaces, iface.Name)
+		}
+	}
+	return s
+}
+
+// Session is the metadata to record the windows of the collector with
+func (c *Collector) Session() Session {
+	s := NewSession(c.opts, c.classes)
+	s.Timer = c.backend.Timer
+	s.Attach = c.backend.Attach
+	return s
+}
+
+// Recorder is a sink writing the windows and the annotations to a
+// recording, to be replayed later with Replay
+type Recorder struct {
+	closer io.Closer
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	buf    []byte
+	last   time.Time
+	err    error
+}
+
+// CreateRecording creates the recording file at path, the file is closed
+// along with the recorder
+func CreateRecording(path string, s Session) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRecorder(f, s)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewRecorder writes the session to w, Close doesn't close w
+func NewRecorder(w io.Writer, s Session) (*Recorder, error) {
+	header := append([]byte(RECORDING_MAGIC), RECORDING_VERSION)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	r := &Recorder{gz: gz, w: bufio.NewWriter(gz)}
+	r.putUvarint(uint64(len(meta)))
+	r.buf = append(r.buf, meta...)
+	r.flush()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r, nil
+}
+
+func (r *Recorder) OnSample(s Sample) {
+	r.buf = append(r.buf, RECORD_SAMPLE)
+	r.putTime(s.Time)
+	r.putUvarint(s.RxBytes)
+	r.putUvarint(s.TxBytes)
+	r.putUvarint(s.RxPackets)
+	r.putUvarint(s.TxPackets)
+	r.putUvarint(uint64(len(s.Classes)))
+	for _, v := range s.Classes {
+		r.putUvarint(v)
+	}
+	for _, h := range []SizeHist{s.RxSizes, s.TxSizes} {
+		for _, v := range h.Buckets {
+			r.putUvarint(v)
+		}
+		r.putUvarint(h.Gso)
+	}
+	r.putUvarint(s.Sources)
+	r.putUvarint(s.Flows)
+	r.flush()
+}
+
+func (r *Recorder) OnAnnotation(a Annotation) {
+	r.buf = append(r.buf, RECORD_ANNOTATION)
+	r.putTime(a.Time)
+	r.putUvarint(uint64(len(a.Text)))
+	r.buf = append(r.buf, a.Text...)
+	r.flush()
+}
+
+// putTime appends the nanoseconds since the last record
+func (r *Recorder) putTime(t time.Time) {
+	var delta int64
+	if r.last.IsZero() {
+		delta = t.UnixNano()
+	} else {
+		delta = int64(t.Sub(r.last))
+	}
+	r.last = t
+	r.buf = binary.AppendVarint(r.buf, delta)
+}
+
+func (r *Recorder) putUvarint(v uint64) {
+	r.buf = binary.AppendUvarint(r.buf, v)
+}
+
+// flush writes the pending record, the first error is kept for Close
+func (r *Recorder) flush() {
+	if r.err == nil {
+		_, r.err = r.w.Write(r.buf)
+	}
+	r.buf = r.buf[:0]
+}
+
+// Close flushes the recording, it returns the first write error if any
+func (r *Recorder) Close() error {
+	errs := []error{r.err}
+	if r.err == nil {
+		errs = append(errs, r.w.Flush(), r.gz.Close())
+	}
+	if r.closer != nil {
+		errs = append(errs, r.closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Replay is a source publishing the windows of a recording
+type Replay struct {
+	// Realtime publishes the windows as far apart as they were recorded,
+	// otherwise they are published as fast as they are consumed (none are
+	// dropped)
+	Realtime bool
+
+	session Session
+	closer  io.Closer
+	r       *bufio.Reader
+	last    time.Time
+	// windows is the number of windows published
+	windows     uint64
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	stopped     bool
+	err         error
+	samples     chan Sample
+	annotations chan Annotation
+}
+
+var _ Source = (*Replay)(nil)
+
+// OpenReplay opens the recording at path, the file is closed on Stop
+func OpenReplay(path string) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReplay(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewReplay reads the session of the recording from r
+func NewReplay(r io.Reader) (*Replay, error) {
+	header := make([]byte, len(RECORDING_MAGIC)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("not a recording: %w", err)
+	}
+	if string(header[:len(RECORDING_MAGIC)]) != RECORDING_MAGIC {
+		return nil, errors.New("not a recording")
+	}
+	version := header[len(RECORDING_MAGIC)]
+	if version != RECORDING_VERSION {
+		return nil, fmt.Errorf("unsupported recording version %d, expected %d", version, RECORDING_VERSION)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	rp := &Replay{r: bufio.NewReader(gz)}
+
+	n, err := binary.ReadUvarint(rp.r)
+	if err != nil {
+		return nil, fmt.Errorf("reading the session: %w", err)
+	}
+	meta := make([]byte, n)
+	if _, err := io.ReadFull(rp.r, meta); err != nil {
+		return nil, fmt.Errorf("reading the session: %w", err)
+	}
+	if err := json.Unmarshal(meta, &rp.session); err != nil {
+		return nil, fmt.Errorf("reading the session: %w", err)
+	}
+	return rp, nil
+}
+
+// Session is the metadata of the recording
+func (rp *Replay) Session() Session {
+	return rp.session
+}
+
+func (rp *Replay) Classes() []Class {
+	return rp.session.Classes
+}
+
+func (rp *Replay) Samples() <-chan Sample {
+	return rp.samples
+}
+
+func (rp *Replay) Annotations() <-chan Annotation {
+	return rp.annotations
+}
+
+// Done is nil before Start, same as Collector.Done
+func (rp *Replay) Done() <-chan struct{} {
+	if rp.ctx == nil {
+		return nil
+	}
+	return rp.ctx.Done()
+}
+
+func (rp *Replay) Start(ctx context.Context) error {
+	rp.ctx, rp.cancel = context.WithCancel(ctx)
+	// Unbuffered unless in real time, same as Synthetic
+	if rp.Realtime {
+		rp.samples = make(chan Sample, SAMPLE_BUFFER)
+		rp.annotations = make(chan Annotation, ANNOTATION_BUFFER)
+	} else {
+		rp.samples = make(chan Sample)
+		rp.annotations = make(chan Annotation)
+	}
+
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		// the recording is over
+		defer rp.cancel()
+		rp.err = rp.run()
+	}()
+
+	return nil
+}
+
+func (rp *Replay) run() error {
+	var first time.Time
+	start := time.Now()
+	for {
+		typ, err := rp.r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return rp.truncated()
+		}
+		if err != nil {
+			return fmt.Errorf("reading the recording: %w", err)
+		}
+
+		var s Sample
+		var a Annotation
+		switch typ {
+		case RECORD_SAMPLE:
+			s, err = rp.readSample()
+		case RECORD_ANNOTATION:
+			a, err = rp.readAnnotation()
+		default:
+			err = fmt.Errorf("unknown record type %q", typ)
+		}
+		// the last record is cut short
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return rp.truncated()
+		}
+		if err != nil {
+			return fmt.Errorf("corrupted recording: %w", err)
+		}
+
+		if rp.Realtime {
+			if first.IsZero() {
+				first = rp.last
+			}
+			select {
+			case <-time.After(time.Until(start.Add(rp.last.Sub(first)))):
+			case <-rp.ctx.Done():
+				return nil
+			}
+		}
+
+		if typ == RECORD_SAMPLE {
+			select {
+			case rp.samples <- s:
+				rp.windows++
+			case <-rp.ctx.Done():
+				return nil
+			}
+		} else {
+			select {
+			case rp.annotations <- a:
+			case <-rp.ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// truncated is the error of a recording cut short, like on a crash. The
+// windows till then are replayed, it is io.ErrUnexpectedEOF for the callers
+// to treat it as a warning.
+func (rp *Replay) truncated() error {
+	return fmt.Errorf("recording truncated after %d windows: %w", rp.windows, io.ErrUnexpectedEOF)
+}
+
+func (rp *Replay) readSample() (Sample, error) {
+	var s Sample
+	var err error
+	if s.Time, err = rp.readTime(); err != nil {
+		return s, err
+	}
+
+	var n uint64
+	fields := []*uint64{&s.RxBytes, &s.TxBytes, &s.RxPackets, &s.TxPackets, &n}
+	for _, f := range fields {
+		if *f, err = binary.ReadUvarint(rp.r); err != nil {
+			return s, err
+		}
+	}
+	if n != uint64(len(rp.session.Classes)) {
+		return s, fmt.Errorf("sample with %d classes, expected %d", n, len(rp.session.Classes))
+	}
+
+	s.Classes = make([]uint64, n)
+	fields = fields[:0]
+	for i := range s.Classes {
+		fields = append(fields, &s.Classes[i])
+	}
+	for _, h := range []*SizeHist{&s.RxSizes, &s.TxSizes} {
+		for i := range h.Buckets {
+			fields = append(fields, &h.Buckets[i])
+		}
+		fields = append(fields, &h.Gso)
+	}
+	fields = append(fields, &s.Sources, &s.Flows)
+	for _, f := range fields {
+		if *f, err = binary.ReadUvarint(rp.r); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func (rp *Replay) readAnnotation() (Annotation, error) {
+	var a Annotation
+	var err error
+	if a.Time, err = rp.readTime(); err != nil {
+		return a, err
+	}
+	n, err := binary.ReadUvarint(rp.r)
+	if err != nil {
+		return a, err
+	}
+	text := make([]byte, n)
+	if _, err := io.ReadFull(rp.r, text); err != nil {
+		return a, err
+	}
+	a.Text = string(text)
+	return a, nil
+}
+
+// readTime reads the nanoseconds since the last record
+func (rp *Replay) readTime() (time.Time, error) {
+	delta, err := binary.ReadVarint(rp.r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if rp.last.IsZero() {
+		rp.last = time.Unix(0, delta)
+	} else {
+		rp.last = rp.last.Add(time.Duration(delta))
+	}
+	return rp.last, nil
+}
+
+// Stop stops the replay and closes the file, returns the error reading the
+// recording if any
+func (rp *Replay) Stop() error {
+	if rp.cancel == nil {
+		return errors.New("source not started")
+	}
+	rp.cancel()
+	rp.wg.Wait()
+	if rp.stopped {
+		return rp.err
+	}
+	rp.stopped = true
+
+	close(rp.samples)
+	close(rp.annotations)
+
+	errs := []error{rp.err}
+	if rp.closer != nil {
+		errs = append(errs, rp.closer.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package microburst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordedSink struct {
+	samples     []Sample
+	annotations []Annotation
+}
+
+func (s *recordedSink) OnSample(sample Sample) {
+	s.samples = append(s.samples, sample)
+}
+
+func (s *recordedSink) OnAnnotation(a Annotation) {
+	s.annotations = append(s.annotations, a)
+}
+
+func (s *recordedSink) Close() error {
+	return nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	session := Session{
+		Host:       "db1",
+		Kernel:     "6.1.0",
+		Interface:  "eth0",
+		Interfaces: []string{"eth0"},
+		Window:     time.Millisecond,
+		Timer:      "bpf",
+		Classes:    []Class{{Name: "multicast", Title: "Received multicast"}},
+		Start:      start,
+	}
+	samples := []Sample{
+		{Time: start, RxBytes: 1500, RxPackets: 1, Classes: []uint64{0}},
+		{Time: start.Add(1100 * time.Microsecond), RxBytes: 150_000, TxBytes: 64, RxPackets: 100, TxPackets: 1, Classes: []uint64{1500}, RxSizes: SizeHist{Buckets: [NR_SIZE_BUCKETS]uint64{4: 100}, Gso: 3}, Sources: 40, Flows: 42},
+		{Time: start.Add(2 * time.Millisecond), Classes: []uint64{0}},
+	}
+	annotation := Annotation{Time: start.Add(1500 * time.Microsecond), Text: "tracking tcp port 443"}
+
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf, session)
+	require.NoError(t, err)
+	r.OnSample(samples[0])
+	r.OnSample(samples[1])
+	r.OnAnnotation(annotation)
+	r.OnSample(samples[2])
+	require.NoError(t, r.Close())
+
+	rp, err := NewReplay(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, "db1", rp.Session().Host)
+	require.Equal(t, "eth0", rp.Session().Interface)
+	require.Equal(t, session.Classes, rp.Classes())
+	require.True(t, start.Equal(rp.Session().Start))
+
+	require.NoError(t, rp.Start(context.Background()))
+	var got recordedSink
+	Dispatch(context.Background(), rp, &got)
+	require.NoError(t, rp.Stop())
+
+	require.Len(t, got.samples, len(samples))
+	for i, s := range samples {
+		require.True(t, s.Time.Equal(got.samples[i].Time))
+		got.samples[i].Time = s.Time
+		require.Equal(t, s, got.samples[i])
+	}
+	require.Len(t, got.annotations, 1)
+	require.Equal(t, annotation.Text, got.annotations[0].Text)
+	require.True(t, annotation.Time.Equal(got.annotations[0].Time))
+}
+
+func TestReplayErrors(t *testing.T) {
+	_, err := NewReplay(bytes.NewReader([]byte("not a recording")))
+	require.ErrorContains(t, err, "not a recording")
+
+	_, err = NewReplay(bytes.NewReader([]byte(RECORDING_MAGIC + "\x09")))
+	require.ErrorContains(t, err, "unsupported recording version 9")
+	_, err = NewReplay(bytes.NewReader([]byte(RECORDING_MAGIC + "\x00")))
+	require.ErrorContains(t, err, "unsupported recording version 0")
+
+	// a recording cut short, like on a crash
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf, Session{})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		r.OnSample(Sample{Time: time.Unix(int64(i), 0), RxBytes: uint64(i)})
+	}
+	require.NoError(t, r.Close())
+
+	rp, err := NewReplay(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	require.NoError(t, err)
+	require.NoError(t, rp.Start(context.Background()))
+	var got recordedSink
+	Dispatch(context.Background(), rp, &got)
+	err = rp.Stop()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.ErrorContains(t, err, fmt.Sprintf("recording truncated after %d windows", len(got.samples)))
+	require.NotEmpty(t, got.samples)
+	// stopping again keeps the error
+	require.ErrorIs(t, rp.Stop(), io.ErrUnexpectedEOF)
+}
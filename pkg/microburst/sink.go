@@ -0,0 +1,89 @@
+package microburst
+
+import (
+	"context"
+	"errors"
+)
+
+// Sink consumes the windows, like a graph, a printer or an exporter
+type Sink interface {
+	// OnSample is called for each window, in order
+	OnSample(s Sample)
+	// OnAnnotation is called for each annotation, like a filter change
+	OnAnnotation(a Annotation)
+	// Close flushes the sink, no calls follow it
+	Close() error
+}
+
+// Fanout is a sink that passes everything to all of its sinks, in order
+type Fanout []Sink
+
+func (f Fanout) OnSample(s Sample) {
+	for _, sink := range f {
+		sink.OnSample(s)
+	}
+}
+
+func (f Fanout) OnAnnotation(a Annotation) {
+	for _, sink := range f {
+		sink.OnAnnotation(a)
+	}
+}
+
+// Close closes all the sinks in order, even if some of them fail
+func (f Fanout) Close() error {
+	var errs []error
+	for _, sink := range f {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Dispatch passes the samples and the annotations of the source to the
+// sink till ctx is done or the source stops. What the source published till
+// then is passed on either way, ctx is usually canceled once the source
+// stops too. The sink is left open.
+func Dispatch(ctx context.Context, src Source, sink Sink) {
+	for {
+		select {
+		case <-ctx.Done():
+			drain(src, sink)
+			return
+		case <-src.Done():
+			drain(src, sink)
+			return
+		case a, ok := <-src.Annotations():
+			if !ok {
+				return
+			}
+			sink.OnAnnotation(a)
+		case s, ok := <-src.Samples():
+			if !ok {
+				return
+			}
+			sink.OnSample(s)
+		}
+	}
+}
+
+// drain passes what the source published before it stopped
+func drain(src Source, sink Sink) {
+	for {
+		select {
+		case a, ok := <-src.Annotations():
+			if !ok {
+				return
+			}
+			sink.OnAnnotation(a)
+		case s, ok := <-src.Samples():
+			if !ok {
+				return
+			}
+			sink.OnSample(s)
+		default:
+			return
+		}
+	}
+}
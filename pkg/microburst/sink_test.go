@@ -0,0 +1,76 @@
+package microburst
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testSink struct {
+	name   string
+	events *[]string
+	err    error
+}
+
+func (s testSink) OnSample(sample Sample) {
+	*s.events = append(*s.events, s.name+" sample "+sample.Time.Format("15:04:05"))
+}
+
+func (s testSink) OnAnnotation(a Annotation) {
+	*s.events = append(*s.events, s.name+" annotation "+a.Text)
+}
+
+func (s testSink) Close() error {
+	*s.events = append(*s.events, s.name+" close")
+	return s.err
+}
+
+func TestFanout(t *testing.T) {
+	var events []string
+	failed := errors.New("failed")
+	f := Fanout{
+		testSink{name: "a", events: &events, err: failed},
+		testSink{name: "b", events: &events},
+	}
+
+	f.OnSample(Sample{Time: time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)})
+	f.OnAnnotation(Annotation{Text: "filters changed"})
+	err := f.Close()
+	require.ErrorIs(t, err, failed)
+
+	require.Equal(t, []string{
+		"a sample 10:00:00",
+		"b sample 10:00:00",
+		"a annotation filters changed",
+		"b annotation filters changed",
+		"a close",
+		"b close",
+	}, events)
+
+	require.NoError(t, Fanout{}.Close())
+}
+
+func TestDispatchDrain(t *testing.T) {
+	// the source is over and ctx canceled too, as main does once the
+	// source stops, the published windows are passed on either way
+	for i := 0; i < 50; i++ {
+		src := &Synthetic{
+			Window:   time.Second,
+			From:     time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC),
+			Realtime: true,
+			Script:   []Step{{Sample: Sample{Classes: []uint64{}}, Repeat: 3}},
+		}
+		require.NoError(t, src.Start(context.Background()))
+		<-src.Done()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var events []string
+		Dispatch(ctx, src, testSink{name: "a", events: &events})
+		require.NoError(t, src.Stop())
+		require.Len(t, events, 3)
+	}
+}
@@ -0,0 +1,83 @@
+package microburst
+
+import (
+	"fmt"
+)
+
+// Same as NR_SIZE_BUCKETS and NR_SIZE_COUNTERS in the bpf code, the size
+// buckets are followed by the count of the GSO/GRO packets
+const (
+	NR_SIZE_BUCKETS  = 11
+	NR_SIZE_COUNTERS = NR_SIZE_BUCKETS + 1
+)
+
+// SizeBucketNames are the ranges of the packet size buckets, by the log2 of
+// the network layer length before GSO segmentation
+var SizeBucketNames = [NR_SIZE_BUCKETS]string{
+	"<128", "128-255", "256-511", "512-1023", "1K-2K", "2K-4K", "4K-8K", "8K-16K", "16K-32K", "32K-64K", "64K+",
+}
+
+// SizeBucketKeys are SizeBucketNames usable as column and field names
+var SizeBucketKeys = [NR_SIZE_BUCKETS]string{
+	"lt128", "128_255", "256_511", "512_1023", "1k_2k", "2k_4k", "4k_8k", "8k_16k", "16k_32k", "32k_64k", "64k_plus",
+}
+
+// Packets in the first bucket are tiny
+const SIZE_TINY_BUCKETS = 1
+
+// SizeHist is the number of packets in each size bucket. The GSO/GRO
+// packets (by skb_shinfo()->gso_size, or gso_segs with tc) are counted in
+// their size bucket and in Gso as well, i.e., a jumbo frame is not mistaken
+// for one.
+type SizeHist struct {
+	Buckets [NR_SIZE_BUCKETS]uint64
+	Gso     uint64
+}
+
+func sizeHistOf(values [NR_COUNTERS]uint64, base int) SizeHist {
+	var h SizeHist
+	copy(h.Buckets[:], values[base:base+NR_SIZE_BUCKETS])
+	h.Gso = values[base+NR_SIZE_BUCKETS]
+	return h
+}
+
+// Add adds the packets of o
+func (h *SizeHist) Add(o SizeHist) {
+	for i, v := range o.Buckets {
+		h.Buckets[i] += v
+	}
+	h.Gso += o.Gso
+}
+
+// Total is the number of packets
+func (h SizeHist) Total() uint64 {
+	var n uint64
+	for _, v := range h.Buckets {
+		n += v
+	}
+	return n
+}
+
+// Mix is the share of the tiny (<128 bytes), MTU sized and GSO/GRO packets
+func (h SizeHist) Mix() (tiny, mtu, gso float64) {
+	total := h.Total()
+	if total == 0 {
+		return 0, 0, 0
+	}
+
+	var t uint64
+	for _, v := range h.Buckets[:SIZE_TINY_BUCKETS] {
+		t += v
+	}
+	g := h.Gso
+	if g > total-t {
+		g = total - t
+	}
+	m := total - t - g
+	return float64(t) / float64(total), float64(m) / float64(total), float64(g) / float64(total)
+}
+
+func (h SizeHist) String() string {
+	tiny, mtu, gso := h.Mix()
+	return fmt.Sprintf("tiny %.0f%% mtu %.0f%% gso %.0f%%", tiny*100, mtu*100, gso*100)
+}
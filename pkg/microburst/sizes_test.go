@@ -0,0 +1,33 @@
+package microburst
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeHist(t *testing.T) {
+	var values [NR_COUNTERS]uint64
+	values[RX_SIZE_PACKETS] = 2
+	values[RX_SIZE_PACKETS+4] = 6
+	// jumbo frames, not GSO
+	values[RX_SIZE_PACKETS+7] = 1
+	values[RX_SIZE_PACKETS+9] = 1
+	values[RX_SIZE_PACKETS+NR_SIZE_BUCKETS] = 1
+	values[TX_SIZE_PACKETS] = 1
+
+	h := sizeHistOf(values, RX_SIZE_PACKETS)
+	require.Equal(t, uint64(10), h.Total())
+	require.Equal(t, uint64(1), h.Gso)
+	tiny, mtu, gso := h.Mix()
+	require.InDelta(t, 0.2, tiny, 1e-9)
+	require.InDelta(t, 0.7, mtu, 1e-9)
+	require.InDelta(t, 0.1, gso, 1e-9)
+	require.Equal(t, "tiny 20% mtu 70% gso 10%", h.String())
+
+	require.Equal(t, SizeHist{Buckets: [NR_SIZE_BUCKETS]uint64{1}}, sizeHistOf(values, TX_SIZE_PACKETS))
+
+	h.Add(h)
+	require.Equal(t, uint64(20), h.Total())
+	require.Equal(t, uint64(2), h.Gso)
+}
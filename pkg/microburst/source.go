@@ -0,0 +1,25 @@
+package microburst
+
+import (
+	"context"
+)
+
+// Source produces the windows, like the bpf programs of a Collector or a
+// Synthetic script
+type Source interface {
+	// Start starts publishing the samples, till ctx is done or Stop is
+	// called
+	Start(ctx context.Context) error
+	// Classes are the series of Sample.Classes, in the same order
+	Classes() []Class
+	Samples() <-chan Sample
+	Annotations() <-chan Annotation
+	// Done is closed once the source stops on its own (like at the end
+	// of a script or on an error) or ctx is done, nil before Start
+	Done() <-chan struct{}
+	// Stop stops the source and closes the channels. Returns the error
+	// that stopped the source, if any. Stopping again is a no-op.
+	Stop() error
+}
+
+var _ Source = (*Collector)(nil)
@@ -0,0 +1,300 @@
+package microburst
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step is a scripted window, or an annotation if Annotation is set
+type Step struct {
+	// Sample is the window, the time is set by the source
+	Sample Sample
+	// Repeat is how many windows to publish, 0 is the same as 1
+	Repeat     int
+	Annotation string
+}
+
+// Synthetic is a source publishing scripted windows, to run the consumers
+// without root or a kernel
+type Synthetic struct {
+	// Window is the time between the windows
+	Window time.Duration
+	// From is the end of the first window, now if zero
+	From time.Time
+	// Realtime publishes the windows a window apart, otherwise they are
+	// published as fast as they are consumed (none are dropped)
+	Realtime bool
+	Script   []Step
+	// Series are the names of Sample.Classes
+	Series []Class
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	stopped     bool
+	samples     chan Sample
+	annotations chan Annotation
+}
+
+var _ Source = (*Synthetic)(nil)
+
+func (s *Synthetic) Classes() []Class {
+	return s.Series
+}
+
+func (s *Synthetic) Samples() <-chan Sample {
+	return s.samples
+}
+
+func (s *Synthetic) Annotations() <-chan Annotation {
+	return s.annotations
+}
+
+// Done is nil before Start, same as Collector.Done
+func (s *Synthetic) Done() <-chan struct{} {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Done()
+}
+
+func (s *Synthetic) Start(ctx context.Context) error {
+	if s.Window <= 0 {
+		return fmt.Errorf("invalid burst window %s", s.Window)
+	}
+	for _, step := range s.Script {
+		if step.Annotation == "" && len(step.Sample.Classes) != len(s.Series) {
+			return fmt.Errorf("sample with %d classes, expected %d", len(step.Sample.Classes), len(s.Series))
+		}
+	}
+
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	// Unbuffered unless in real time, so that the consumer sees the
+	// annotations in order with the windows
+	if s.Realtime {
+		s.samples = make(chan Sample, SAMPLE_BUFFER)
+		s.annotations = make(chan Annotation, ANNOTATION_BUFFER)
+	} else {
+		s.samples = make(chan Sample)
+		s.annotations = make(chan Annotation)
+	}
+
+	start := s.From
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		// the script is over
+		defer s.cancel()
+
+		t := start
+		for _, step := range s.Script {
+			if step.Annotation != "" {
+				select {
+				case s.annotations <- Annotation{Time: t, Text: step.Annotation}:
+				case <-s.ctx.Done():
+					return
+				}
+				continue
+			}
+
+			for i := 0; i < step.Repeat || i == 0; i++ {
+				if s.Realtime {
+					select {
+					case <-time.After(time.Until(t)):
+					case <-s.ctx.Done():
+						return
+					}
+				}
+
+				sample := step.Sample
+				sample.Time = t
+				select {
+				case s.samples <- sample:
+				case <-s.ctx.Done():
+					return
+				}
+				t = t.Add(s.Window)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *Synthetic) Stop() error {
+	if s.cancel == nil {
+		return errors.New("source not started")
+	}
+	s.cancel()
+	s.wg.Wait()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.samples)
+		close(s.annotations)
+	}
+	return nil
+}
+
+// Patterns generate the scripts of the synthetic patterns, by the number
+// of windows
+var Patterns = map[string]func(windows int) []Step{
+	// same bytes in every window
+	"steady": func(windows int) []Step {
+		return []Step{{Sample: syntheticSample(1_000, 2_000), Repeat: windows}}
+	},
+	// a 10 window burst of 100x the bytes every 100 windows
+	"bursts": func(windows int) []Step {
+		var steps []Step
+		for n := 0; n < windows; n += 100 {
+			steps = append(steps,
+				Step{Sample: syntheticSample(100_000, 200_000), Repeat: minInt(10, windows-n)},
+			)
+			if windows-n > 10 {
+				steps = append(steps, Step{Sample: syntheticSample(1_000, 2_000), Repeat: minInt(90, windows-n-10)})
+			}
+		}
+		return steps
+	},
+	// exponentially distributed bytes, the same on every run
+	"random": func(windows int) []Step {
+		r := rand.New(rand.NewSource(1))
+		steps := make([]Step, windows)
+		for i := range steps {
+			steps[i].Sample = syntheticSample(uint64(r.ExpFloat64()*10_000), uint64(r.ExpFloat64()*20_000))
+		}
+		return steps
+	},
+}
+
+// syntheticSample is a window with MTU sized packets
+func syntheticSample(rx uint64, tx uint64) Sample {
+	return Sample{
+		RxBytes:   rx,
+		TxBytes:   tx,
+		RxPackets: (rx + 1499) / 1500,
+		TxPackets: (tx + 1499) / 1500,
+		Classes:   []uint64{},
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ReadScript reads the script of a synthetic source, one step per line:
+//
+//	classes <name>,...                 the class series, before the windows
+//	<rx> <tx> [<class>...] [x<count>]  a window, repeated count times
+//	@ <text>                           an annotation
+//
+// The rx and tx are bytes[/packets], like 15000/10. Empty lines and the
+// ones starting with # are skipped.
+func ReadScript(r io.Reader) ([]Step, []Class, error) {
+	var steps []Step
+	var classes []Class
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "@") {
+			steps = append(steps, Step{Annotation: strings.TrimSpace(text[1:])})
+			continue
+		}
+
+		if names, ok := strings.CutPrefix(text, "classes "); ok {
+			if len(steps) > 0 {
+				return nil, nil, fmt.Errorf("line %d: classes after the windows", line)
+			}
+			for _, name := range strings.Split(names, ",") {
+				name = strings.TrimSpace(name)
+				classes = append(classes, Class{Name: name, Title: name})
+			}
+			continue
+		}
+
+		step, err := parseStep(strings.Fields(text), len(classes))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return steps, classes, nil
+}
+
+func parseStep(fields []string, numClasses int) (Step, error) {
+	step := Step{Repeat: 1}
+
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "x") {
+		repeat, err := strconv.Atoi(fields[n-1][1:])
+		if err != nil || repeat < 1 {
+			return step, fmt.Errorf("invalid repeat %q", fields[n-1])
+		}
+		step.Repeat = repeat
+		fields = fields[:n-1]
+	}
+
+	if len(fields) != 2+numClasses {
+		return step, fmt.Errorf("expected rx, tx and %d classes, got %d values", numClasses, len(fields))
+	}
+
+	var err error
+	step.Sample.RxBytes, step.Sample.RxPackets, err = parseBytesPackets(fields[0])
+	if err != nil {
+		return step, err
+	}
+	step.Sample.TxBytes, step.Sample.TxPackets, err = parseBytesPackets(fields[1])
+	if err != nil {
+		return step, err
+	}
+
+	step.Sample.Classes = make([]uint64, numClasses)
+	for i, f := range fields[2:] {
+		step.Sample.Classes[i], err = strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return step, fmt.Errorf("invalid class bytes %q", f)
+		}
+	}
+
+	return step, nil
+}
+
+// parseBytesPackets parses bytes[/packets]
+func parseBytesPackets(s string) (uint64, uint64, error) {
+	b, p, hasPackets := strings.Cut(s, "/")
+	bytes, err := strconv.ParseUint(b, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid bytes %q", s)
+	}
+	if !hasPackets {
+		return bytes, 0, nil
+	}
+	packets, err := strconv.ParseUint(p, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid packets %q", s)
+	}
+	return bytes, packets, nil
+}
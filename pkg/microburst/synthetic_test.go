@@ -0,0 +1,82 @@
+package microburst
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadScript(t *testing.T) {
+	steps, classes, err := ReadScript(strings.NewReader(`
+# warm up
+classes multicast,rx:dscp=ef
+1000/1 2000/2 0 10 x3
+@ filters changed
+150000 3000 1000 0
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Class{{Name: "multicast", Title: "multicast"}, {Name: "rx:dscp=ef", Title: "rx:dscp=ef"}}, classes)
+	require.Equal(t, []Step{
+		{Sample: Sample{RxBytes: 1000, RxPackets: 1, TxBytes: 2000, TxPackets: 2, Classes: []uint64{0, 10}}, Repeat: 3},
+		{Annotation: "filters changed"},
+		{Sample: Sample{RxBytes: 150000, TxBytes: 3000, Classes: []uint64{1000, 0}}, Repeat: 1},
+	}, steps)
+
+	_, _, err = ReadScript(strings.NewReader("1000 2000 5\n"))
+	require.ErrorContains(t, err, "line 1: expected rx, tx and 0 classes")
+	_, _, err = ReadScript(strings.NewReader("1000 2000 x0\n"))
+	require.Error(t, err)
+	_, _, err = ReadScript(strings.NewReader("1000 2000\nclasses local\n"))
+	require.Error(t, err)
+}
+
+func TestSynthetic(t *testing.T) {
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	src := &Synthetic{
+		Window: time.Second,
+		From:   start,
+		Script: []Step{
+			{Sample: Sample{RxBytes: 1, Classes: []uint64{}}, Repeat: 2},
+			{Annotation: "filters changed"},
+			{Sample: Sample{RxBytes: 2, Classes: []uint64{}}},
+		},
+	}
+	require.NoError(t, src.Start(context.Background()))
+
+	var events []string
+	Dispatch(context.Background(), src, testSink{name: "a", events: &events})
+	require.NoError(t, src.Stop())
+
+	require.Equal(t, []string{
+		"a sample 10:00:00",
+		"a sample 10:00:01",
+		"a annotation filters changed",
+		"a sample 10:00:02",
+	}, events)
+}
+
+func TestSyntheticStop(t *testing.T) {
+	src := &Synthetic{Window: time.Second, Script: []Step{{Sample: Sample{Classes: []uint64{}}}}}
+	require.Nil(t, src.Done())
+	require.Error(t, src.Stop())
+
+	require.NoError(t, src.Start(context.Background()))
+	require.NoError(t, src.Stop())
+	require.NoError(t, src.Stop())
+}
+
+func TestPatterns(t *testing.T) {
+	for name, pattern := range Patterns {
+		windows := 0
+		for _, step := range pattern(250) {
+			windows += step.Repeat
+			if step.Repeat == 0 {
+				windows++
+			}
+		}
+		require.Equal(t, 250, windows, name)
+	}
+}
@@ -0,0 +1,487 @@
+package microburst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"golang.org/x/sys/unix"
+)
+
+// startTimer starts the timer of the chosen backend, the closers undo it
+func (c *Collector) startTimer() error {
+	switch c.backend.Timer {
+	case "perf":
+		perfFd, rb, err := c.setupPerfTimer()
+		if err != nil {
+			return err
+		}
+		c.closers = append(c.closers, func() {
+			if err := syscall.Close(perfFd); err != nil {
+				log.Printf("failed to close perf event: %v", err)
+			}
+			rb.Close()
+		})
+	case "perf-percpu":
+		perfFds, rb, err := c.setupPerCpuPerfTimer()
+		if err != nil {
+			return err
+		}
+		c.closers = append(c.closers, func() {
+			for _, fd := range perfFds {
+				if err := syscall.Close(fd); err != nil {
+					log.Printf("failed to close perf event: %v", err)
+				}
+			}
+			rb.Close()
+		})
+	case "go":
+		err := c.setupGoTimer()
+		if err != nil {
+			return err
+		}
+	case "bpf":
+		rb, err := c.setupBpfTimer()
+		if err != nil {
+			return err
+		}
+		c.closers = append(c.closers, rb.Close)
+	default:
+		return fmt.Errorf("invalid timer option %q", c.backend.Timer)
+	}
+
+	return nil
+}
+
+func (c *Collector) classTracked(key int) bool {
+	for _, class := range c.classes {
+		if class.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Collector) getCounterValues(txrxInfo *bpf.BPFMap) ([NR_COUNTERS]uint64, error) {
+	var counters [NR_COUNTERS]uint64
+	trackRx, trackTx := c.opts.TrackRx, c.opts.TrackTx
+
+	for key := 0; key < NR_COUNTERS; key++ {
+		if !trackRx && (key == RX_BYTES || key == RX_PACKETS) {
+			continue
+		}
+		if key >= RX_SOURCES {
+			if !c.opts.Incast {
+				continue
+			}
+		} else if key >= RX_SIZE_PACKETS {
+			if !c.opts.PacketSizes || (key < TX_SIZE_PACKETS && !trackRx) || (key >= TX_SIZE_PACKETS && !trackTx) {
+				continue
+			}
+		} else if key >= RX_HOST_BYTES && !c.classTracked(key) {
+			continue
+		}
+		if !trackTx && (key == TX_BYTES || key == TX_PACKETS) {
+			continue
+		}
+
+		k := uint32(key)
+		values := make([]byte, 8*c.numCpus)
+		err := txrxInfo.GetValueReadInto(unsafe.Pointer(&k), &values)
+		if err != nil {
+			return counters, err
+		}
+		last := 0
+		for i := 0; i < c.numCpus; i++ {
+			cnt := binary.LittleEndian.Uint64(values[last : last+8])
+			last += 8
+			counters[key] += cnt
+		}
+	}
+
+	return counters, nil
+}
+
+func (c *Collector) setupPerfTimer() (int, *bpf.RingBuffer, error) {
+	prog, err := c.module.GetProgram("calc_metrics")
+	if err != nil {
+		return -1, nil, fmt.Errorf("error getting program for calc_metrics: %w", err)
+	}
+
+	cpuChosen := c.chooseCpuForPerfTimer()
+	fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		// We will use periodic sampling, we will not use the frequency
+		Sample: uint64(c.opts.Window.Nanoseconds()),
+		// Sample: uint64(1_000_0),
+		// Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	}, -1, cpuChosen, -1, 0)
+	if err != nil {
+		return -1, nil, fmt.Errorf("open perf event: %w", err)
+	}
+
+	_, err = prog.AttachPerfEvent(fd)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return -1, nil, fmt.Errorf("failed to attach program (%s): %v", prog.Name(), err)
+	}
+
+	if c.opts.Debug {
+		log.Printf("setup perf timer on cpu %d with %s periodic sampling", cpuChosen, c.opts.Window)
+	}
+
+	rb, err := c.startEventsReader()
+	if err != nil {
+		_ = syscall.Close(fd)
+		return -1, nil, err
+	}
+
+	return fd, rb, nil
+}
+
+func (c *Collector) setupPerCpuPerfTimer() ([]int, *bpf.RingBuffer, error) {
+	prog, err := c.module.GetProgram("calc_local_metrics")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting program for calc_local_metrics: %w", err)
+	}
+
+	closeFds := func(fds []int) {
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+	}
+
+	// The cpu ids can have holes, like 0-3,8-11 with 4-7 offline, so go
+	// over the possible ones and skip the offline ones below
+	cpus, err := possibleCpus()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fds []int
+	for _, cpu := range cpus {
+		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+			Type:   unix.PERF_TYPE_SOFTWARE,
+			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Sample: uint64(c.opts.Window.Nanoseconds()),
+		}, -1, cpu, -1, 0)
+		if err == unix.ENODEV {
+			// offline cpu
+			if c.opts.Debug {
+				log.Printf("skipping perf timer on offline cpu %d", cpu)
+			}
+			continue
+		}
+		if err != nil {
+			closeFds(fds)
+			return nil, nil, fmt.Errorf("open perf event on cpu %d: %w", cpu, err)
+		}
+		fds = append(fds, fd)
+
+		_, err = prog.AttachPerfEvent(fd)
+		if err != nil {
+			closeFds(fds)
+			return nil, nil, fmt.Errorf("failed to attach program (%s) on cpu %d: %v", prog.Name(), cpu, err)
+		}
+	}
+
+	if c.opts.Debug {
+		log.Printf("setup perf timer on %d cpus with %s periodic sampling", len(fds), c.opts.Window)
+	}
+
+	eventsChannel := make(chan []byte)
+	rb, err := c.module.InitRingBuf("cpu_events", eventsChannel)
+	if err != nil {
+		closeFds(fds)
+		return nil, nil, fmt.Errorf("init ringbuf: %w", err)
+	}
+
+	rb.Poll(300)
+
+	merger := newWindowMerger(c.opts.Window, len(fds), time.Unix(int64(c.btime), 0))
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for {
+			select {
+			case b := <-eventsChannel:
+				s := cpuStats{
+					ts:     binary.LittleEndian.Uint64(b[0:8]),
+					cpu:    binary.LittleEndian.Uint32(b[8:12]),
+					values: decodeCounters(b[16:]),
+				}
+
+				for _, w := range merger.add(s) {
+					c.publish(w)
+				}
+
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return fds, rb, nil
+}
+
+func (c *Collector) setupBpfTimer() (*bpf.RingBuffer, error) {
+	prog, err := c.module.GetProgram("start_metrics_timer")
+	if err != nil {
+		return nil, fmt.Errorf("error getting program for start_metrics_timer: %w", err)
+	}
+
+	// Start the reader first, so that we don't miss the first few events
+	rb, err := c.startEventsReader()
+	if err != nil {
+		return nil, err
+	}
+
+	// The timer is cancelled by the kernel when the metrics_timer map is
+	// freed, i.e., when the module is closed
+	err = runBpfProg(prog.FileDescriptor(), nil)
+	if err != nil {
+		rb.Close()
+		return nil, fmt.Errorf("failed to start bpf timer (%s): %w", prog.Name(), err)
+	}
+
+	if c.opts.Debug {
+		log.Printf("setup bpf timer with %s interval", c.opts.Window)
+	}
+
+	return rb, nil
+}
+
+// bpfProgRunAttr mirrors the test struct of union bpf_attr used by
+// BPF_PROG_RUN
+type bpfProgRunAttr struct {
+	progFd      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      uint64
+	dataOut     uint64
+	repeat      uint32
+	duration    uint32
+	ctxSizeIn   uint32
+	ctxSizeOut  uint32
+	ctxIn       uint64
+	ctxOut      uint64
+	flags       uint32
+	cpu         uint32
+	batchSize   uint32
+}
+
+// runBpfProg runs the given program once using BPF_PROG_RUN (libbpfgo
+// doesn't expose bpf_prog_test_run_opts), with data as the packet if given
+func runBpfProg(progFd int, data []byte) error {
+	attr := bpfProgRunAttr{
+		progFd: uint32(progFd),
+	}
+	if len(data) > 0 {
+		attr.dataIn = uint64(uintptr(unsafe.Pointer(&data[0])))
+		attr.dataSizeIn = uint32(len(data))
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_RUN, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return errno
+	}
+	if attr.retval != 0 {
+		return fmt.Errorf("program returned %d", attr.retval)
+	}
+
+	return nil
+}
+
+// startEventsReader consumes the xfer_metric events submitted by the bpf
+// side timers (perf or bpf) and publishes them
+func (c *Collector) startEventsReader() (*bpf.RingBuffer, error) {
+	eventsChannel := make(chan []byte)
+	rb, err := c.module.InitRingBuf("events", eventsChannel)
+	if err != nil {
+		return nil, fmt.Errorf("init ringbuf: %w", err)
+	}
+
+	rb.Poll(300)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for {
+			select {
+			case b := <-eventsChannel:
+				ts := binary.LittleEndian.Uint64(b[0:8])
+				values := decodeCounters(b[8:])
+
+				n := time.Unix(int64(c.btime), int64(ts))
+				c.publish(newRxTxStats(n, values))
+
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rb, nil
+}
+
+func (c *Collector) setupGoTimer() error {
+	txrxInfo, err := c.module.GetMap("txrx_info")
+	if err != nil {
+		return err
+	}
+	incastWindow, err := c.module.GetMap("incast_window")
+	if err != nil {
+		return err
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		var last [NR_COUNTERS]uint64
+
+		for {
+			// NOTE: we rely on the go timer for calculating
+			// rate, so our burst rate calculation is going to
+			// be only as good as its granularity/accuracy. Use
+			// timer=bpf to compute this in the bpf code itself
+			// (using bpf_timer) on kernels that support it.
+			//
+			time.Sleep(c.opts.Window)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			default:
+			}
+
+			n := time.Now()
+
+			curr, err := c.getCounterValues(txrxInfo)
+			if err != nil {
+				c.fail(fmt.Errorf("read txrx_info: %w", err))
+				return
+			}
+			if c.opts.Incast {
+				err = nextIncastWindow(incastWindow)
+				if err != nil {
+					c.fail(err)
+					return
+				}
+			}
+
+			// Untracked counters are left as 0, so they stay 0 here
+			// as well
+			// TODO: handle wraparound
+			var act [NR_COUNTERS]uint64
+			for i := range curr {
+				act[i] = curr[i] - last[i]
+			}
+			last = curr
+
+			c.publish(newRxTxStats(n, act))
+		}
+	}()
+
+	return nil
+}
+
+// nextIncastWindow starts a new incast window, like emit_metrics does in
+// the bpf code for the other timers
+func nextIncastWindow(incastWindow *bpf.BPFMap) error {
+	key := uint32(0)
+	value, err := incastWindow.GetValue(unsafe.Pointer(&key))
+	if err != nil {
+		return fmt.Errorf("read incast_window: %w", err)
+	}
+
+	binary.LittleEndian.PutUint64(value[0:8], binary.LittleEndian.Uint64(value[0:8])+1)
+	err = incastWindow.Update(unsafe.Pointer(&key), unsafe.Pointer(&value[0]))
+	if err != nil {
+		return fmt.Errorf("update incast_window: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Collector) chooseCpuForPerfTimer() int {
+	if c.opts.PerfCpu != -1 {
+		return c.opts.PerfCpu
+	}
+
+	// We should choose a CPU that's not having too many irqs assigned
+	// to it.  Since cpu 0 is usually the busiest, we'll probably choose
+	// something from the end
+	//
+	// TODO: Properly choose a CPU by looking at the irq assignments,
+	// cpu topology etc
+
+	cpu := runtime.NumCPU() - 1
+	if cpu < 0 {
+		cpu = 0
+	}
+
+	return cpu
+}
+
+// Where the kernel lists the cpus that can ever be online
+const POSSIBLE_CPUS_PATH = "/sys/devices/system/cpu/possible"
+
+// possibleCpus are the ids of the possible cpus, online or not
+func possibleCpus() ([]int, error) {
+	b, err := os.ReadFile(POSSIBLE_CPUS_PATH)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := parseCpuList(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", POSSIBLE_CPUS_PATH, err)
+	}
+	return cpus, nil
+}
+
+// parseCpuList parses a kernel cpu list, like "0-3,8-11"
+func parseCpuList(s string) ([]int, error) {
+	var cpus []int
+
+	for _, v := range strings.Split(s, ",") {
+		if v == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(v, "-")
+		if !isRange {
+			hi = lo
+		}
+		cpuLo, err := strconv.Atoi(lo)
+		if err != nil || cpuLo < 0 {
+			return nil, fmt.Errorf("invalid cpu %q", v)
+		}
+		cpuHi, err := strconv.Atoi(hi)
+		if err != nil || cpuLo > cpuHi {
+			return nil, fmt.Errorf("invalid cpu range %q", v)
+		}
+
+		for cpu := cpuLo; cpu <= cpuHi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
@@ -0,0 +1,30 @@
+package microburst
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCpuList(t *testing.T) {
+	cpus, err := parseCpuList("0-3,8-11")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 8, 9, 10, 11}, cpus)
+
+	cpus, err = parseCpuList("0")
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, cpus)
+
+	_, err = parseCpuList("3-1")
+	require.Error(t, err)
+	_, err = parseCpuList("a")
+	require.Error(t, err)
+
+	// the running kernel
+	if _, err := os.Stat(POSSIBLE_CPUS_PATH); err == nil {
+		cpus, err := possibleCpus()
+		require.NoError(t, err)
+		require.NotEmpty(t, cpus)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/dustin/go-humanize"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// printer prints the windows above the thresholds, one per line, and the
+// timer accuracy at the end
+type printer struct {
+	w             io.Writer
+	rxThreshold   uint64
+	txThreshold   uint64
+	trackRx       bool
+	trackTx       bool
+	classes       []microburst.Class
+	packetSizes   bool
+	incast        bool
+	incastSources uint64
+	lastTime      time.Time
+	timerHist     *hdrhistogram.Histogram
+}
+
+func newPrinter(w io.Writer, classes []microburst.Class) *printer {
+	return &printer{
+		w:             w,
+		rxThreshold:   rxThreshold,
+		txThreshold:   txThreshold,
+		trackRx:       options.TrackRx,
+		trackTx:       options.TrackTx,
+		classes:       classes,
+		packetSizes:   options.PacketSizes,
+		incast:        options.Incast,
+		incastSources: incastSources,
+		timerHist:     hdrhistogram.New(1, int64(10_000_000_000), 5),
+	}
+}
+
+func (p *printer) OnSample(s microburst.Sample) {
+	timerAccuracy := s.Time.Sub(p.lastTime)
+	p.lastTime = s.Time
+	p.timerHist.RecordValue(int64(timerAccuracy))
+
+	var rx, tx, rxPkts, txPkts string
+	var print bool
+	if p.trackRx && s.RxBytes > p.rxThreshold {
+		rx = humanize.Bytes(s.RxBytes)
+		rxPkts = fmt.Sprintf("(%d pkts)", s.RxPackets)
+		print = true
+	} else {
+		rx = "-"
+	}
+	if p.trackTx && s.TxBytes > p.txThreshold {
+		tx = humanize.Bytes(s.TxBytes)
+		txPkts = fmt.Sprintf("(%d pkts)", s.TxPackets)
+		print = true
+	} else {
+		tx = "-"
+	}
+	if !print {
+		return
+	}
+
+	var cls strings.Builder
+	for i, class := range p.classes {
+		v := "-"
+		if s.Classes[i] > 0 {
+			v = humanize.Bytes(s.Classes[i])
+		}
+		fmt.Fprintf(&cls, " %s: %-10s", class.Name, v)
+	}
+	if p.packetSizes && p.trackRx {
+		fmt.Fprintf(&cls, " rx sizes: %s", s.RxSizes)
+	}
+	if p.packetSizes && p.trackTx {
+		fmt.Fprintf(&cls, " tx sizes: %s", s.TxSizes)
+	}
+	if p.incast {
+		fmt.Fprintf(&cls, " sources: %-6d flows: %-6d", s.Sources, s.Flows)
+		if s.Sources >= p.incastSources {
+			cls.WriteString(" INCAST")
+		}
+	}
+	fmt.Fprintf(p.w, "%s [%10v]: rx: %-10s %-14s tx: %-10s %-14s%s\n", s.Time.Format("15:04:05.000"), timerAccuracy, rx, rxPkts, tx, txPkts, cls.String())
+}
+
+func (p *printer) OnAnnotation(a microburst.Annotation) {
+	fmt.Fprintf(p.w, "%s --- %s\n", a.Time.Format("15:04:05.000"), a.Text)
+}
+
+// Close prints the timer accuracy
+func (p *printer) Close() error {
+	fmt.Fprintf(p.w, "Timer accuracy: \n")
+	fmt.Fprintf(p.w, "Mean: %v StdDev: %v Min: %v Max: %v\n", time.Duration(p.timerHist.Mean()), time.Duration(int64(p.timerHist.StdDev())), time.Duration(p.timerHist.Min()), time.Duration(p.timerHist.Max()))
+	fmt.Fprintf(p.w, "Histogram:\n")
+	fmt.Fprintln(p.w, getHistogram(p.timerHist, func(v float64) string { return time.Duration(int64(v)).String() }))
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// runSynthetic feeds the script to the sink, like main does with the bpf
+// collector
+func runSynthetic(t *testing.T, script string, sink microburst.Sink) []microburst.Class {
+	steps, classes, err := microburst.ReadScript(strings.NewReader(script))
+	require.NoError(t, err)
+
+	src := &microburst.Synthetic{
+		Window: time.Millisecond,
+		From:   time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC),
+		Script: steps,
+		Series: classes,
+	}
+	require.NoError(t, src.Start(context.Background()))
+	microburst.Dispatch(context.Background(), src, sink)
+	require.NoError(t, src.Stop())
+	return classes
+}
+
+func TestPrinter(t *testing.T) {
+	var b bytes.Buffer
+	p := newPrinter(&b, []microburst.Class{{Name: "multicast"}})
+	p.rxThreshold = 1000
+	p.txThreshold = 1 << 40
+
+	runSynthetic(t, `
+classes multicast
+500/1 0 0
+1500000/1000 0 1000 x2
+@ filters changed
+`, p)
+	require.NoError(t, p.Close())
+
+	lines := strings.Split(b.String(), "\n")
+	require.Equal(t, "10:00:00.001 [       1ms]: rx: 1.5 MB     (1000 pkts)    tx: -                         multicast: 1.0 kB    ", lines[0])
+	require.Equal(t, "10:00:00.002 [       1ms]: rx: 1.5 MB     (1000 pkts)    tx: -                         multicast: 1.0 kB    ", lines[1])
+	require.Equal(t, "10:00:00.003 --- filters changed", lines[2])
+	require.Equal(t, "Timer accuracy: ", lines[3])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+// sizeStats are the packet size histograms of the burst and the idle
+// windows of a direction. A window is a burst if its bytes are above the
+// threshold, or with no threshold, above twice the running mean of the
+// windows with traffic so far.
+type sizeStats struct {
+	threshold    uint64
+	windows      uint64
+	bytes        uint64
+	burst        microburst.SizeHist
+	idle         microburst.SizeHist
+	burstWindows uint64
+	idleWindows  uint64
+}
+
+func (s *sizeStats) isBurst(bytes uint64) bool {
+	if s.threshold > 0 {
+		return bytes > s.threshold
+	}
+	return s.windows > 0 && bytes > 2*s.bytes/s.windows
+}
+
+// add records the packet sizes of a window with the given bytes
+func (s *sizeStats) add(bytes uint64, h microburst.SizeHist) {
+	if s.isBurst(bytes) {
+		s.burstWindows++
+		s.burst.Add(h)
+	} else {
+		s.idleWindows++
+		s.idle.Add(h)
+	}
+
+	if bytes > 0 {
+		s.windows++
+		s.bytes += bytes
+	}
+}
+
+// print writes the histograms of the burst and the idle windows side by
+// side
+func (s *sizeStats) print(w io.Writer, title string) {
+	fmt.Fprintf(w, "%s packet sizes (%d burst windows, %d idle windows):\n", title, s.burstWindows, s.idleWindows)
+	fmt.Fprintf(w, "%-10s %14s %14s\n", "size", "burst", "idle")
+
+	burstTotal, idleTotal := s.burst.Total(), s.idle.Total()
+	for i, name := range microburst.SizeBucketNames {
+		fmt.Fprintf(w, "%-10s %14s %14s\n", name, sizeShare(s.burst.Buckets[i], burstTotal), sizeShare(s.idle.Buckets[i], idleTotal))
+	}
+
+	burstTiny, burstMtu, burstGso := s.burst.Mix()
+	idleTiny, idleMtu, idleGso := s.idle.Mix()
+	fmt.Fprintf(w, "%-10s %13.1f%% %13.1f%%\n", "tiny", burstTiny*100, idleTiny*100)
+	fmt.Fprintf(w, "%-10s %13.1f%% %13.1f%%\n", "mtu", burstMtu*100, idleMtu*100)
+	fmt.Fprintf(w, "%-10s %13.1f%% %13.1f%%\n", "gso", burstGso*100, idleGso*100)
+	fmt.Fprintln(w)
+}
+
+func sizeShare(v uint64, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%.1f%%)", v, float64(v)*100/float64(total))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+func TestSizeStats(t *testing.T) {
+	tiny := microburst.SizeHist{Buckets: [microburst.NR_SIZE_BUCKETS]uint64{10}}
+	big := microburst.SizeHist{Buckets: [microburst.NR_SIZE_BUCKETS]uint64{9: 10}, Gso: 10}
+
+	// twice the running mean of the windows with traffic
+	var s sizeStats
+	s.add(1000, tiny)
+	s.add(0, microburst.SizeHist{})
+	s.add(1000, tiny)
+	s.add(5000, big)
+	s.add(1000, tiny)
+	require.Equal(t, uint64(1), s.burstWindows)
+	require.Equal(t, uint64(4), s.idleWindows)
+	require.Equal(t, big, s.burst)
+	require.Equal(t, microburst.SizeHist{Buckets: [microburst.NR_SIZE_BUCKETS]uint64{30}}, s.idle)
+
+	s = sizeStats{threshold: 500}
+	s.add(1000, tiny)
+	s.add(100, big)
+	require.Equal(t, tiny, s.burst)
+	require.Equal(t, big, s.idle)
+
+	var b bytes.Buffer
+	s.print(&b, "Received")
+	require.Contains(t, b.String(), "Received packet sizes (1 burst windows, 1 idle windows)")
+	require.Contains(t, b.String(), "<128          10 (100.0%)       0 (0.0%)\n")
+	require.Contains(t, b.String(), "gso                  0.0%         100.0%\n")
+}
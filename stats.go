@@ -2,180 +2,153 @@ package main
 
 import (
 	"bytes"
-	"container/ring"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"os"
 	"strings"
-	"time"
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/dustin/go-humanize"
-	"github.com/go-echarts/go-echarts/v2/charts"
-	"github.com/go-echarts/go-echarts/v2/components"
-	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/surki/network-microburst/pkg/microburst"
 )
 
-var (
-	rxHist, txHist *hdrhistogram.Histogram
-	rxData, txData *ring.Ring
-)
+// summary keeps the histograms and the packet size and incast stats of
+// the windows, they are printed at the end
+type summary struct {
+	w           io.Writer
+	trackRx     bool
+	trackTx     bool
+	classes     []microburst.Class
+	accounting  string
+	packetSizes bool
+	incast      bool
+	rxHist      *windowHist
+	txHist      *windowHist
+	classHists  []*windowHist
+	annotations []microburst.Annotation
+	rxSizes     sizeStats
+	txSizes     sizeStats
+	incasts     incastStats
+}
 
-func statsInit() {
-	if printHistogram {
-		rxHist = hdrhistogram.New(1, int64(10000000000), 3)
-		txHist = hdrhistogram.New(1, int64(10000000000), 3)
-	}
-	if saveGraphHtmlPath != "" {
-		// We will try to have at least last 10 seconds of data.
-		// But if it crosses 1 million points, we will limit it to 1
-		// million. This is to avoid the browser from hanging.
-		// TODO: Maybe we can parameterize this.
-		numSamplesPerSec := int(time.Second / burstWindow)
-		numSamples := numSamplesPerSec * 10
-		if numSamples > 1_000_000 {
-			numSamples = 1_000_000
-		}
-		rxData = ring.New(numSamples)
-		txData = ring.New(numSamples)
-	}
+// windowHist is the histogram of the bytes per window of a series, shared
+// by the summary and the OTLP export
+type windowHist struct {
+	*hdrhistogram.Histogram
+	// sum is exact, the histogram values are rounded to 3 digits
+	sum uint64
 }
 
-func statsFinish() {
-	if printHistogram {
-		fmt.Println("Received:")
-		fmt.Printf("Mean: %v   StdDev: %v   Min: %v   Max: %v\n", humanize.Bytes(uint64(rxHist.Mean())), humanize.Bytes(uint64(rxHist.StdDev())), humanize.Bytes(uint64(rxHist.Min())), humanize.Bytes(uint64(rxHist.Max())))
-		fmt.Printf("Histogram:\n")
-		fmt.Println(getHistogram(rxHist, func(v float64) string { return humanize.Bytes(uint64(v)) }))
-
-		fmt.Println("Transferred:")
-		fmt.Printf("Mean: %v   StdDev: %v   Min: %v   Max: %v\n", humanize.Bytes(uint64(txHist.Mean())), humanize.Bytes(uint64(txHist.StdDev())), humanize.Bytes(uint64(txHist.Min())), humanize.Bytes(uint64(txHist.Max())))
-		fmt.Printf("Histogram:\n")
-		fmt.Println(getHistogram(txHist, func(v float64) string { return humanize.Bytes(uint64(v)) }))
-	}
+func newWindowHist() *windowHist {
+	return &windowHist{Histogram: hdrhistogram.New(1, int64(10000000000), 3)}
+}
 
-	if saveGraphHtmlPath != "" {
-		saveGraph()
-	}
+func (h *windowHist) record(bytes uint64) {
+	h.RecordValue(int64(bytes))
+	h.sum += bytes
 }
 
-func statsHandleRxData(t time.Time, rxbytes uint64) {
-	if rxHist != nil {
-		rxHist.RecordValue(int64(rxbytes))
+func newSummary(w io.Writer, classes []microburst.Class) *summary {
+	s := &summary{
+		w:           w,
+		trackRx:     options.TrackRx,
+		trackTx:     options.TrackTx,
+		classes:     classes,
+		accounting:  options.Accounting,
+		packetSizes: options.PacketSizes,
+		incast:      options.Incast,
+		rxSizes:     sizeStats{threshold: burstBytes},
+		txSizes:     sizeStats{threshold: burstBytes},
+		incasts:     incastStats{threshold: incastSources},
 	}
-
-	if rxData != nil {
-		rxData.Value = statData{t, rxbytes}
-		rxData = rxData.Next()
+	if printHistogram {
+		s.rxHist = newWindowHist()
+		s.txHist = newWindowHist()
+		for range classes {
+			s.classHists = append(s.classHists, newWindowHist())
+		}
 	}
+	return s
 }
 
-func statsHandleTxData(t time.Time, txbytes uint64) {
-	if txHist != nil {
-		txHist.RecordValue(int64(txbytes))
+func (s *summary) OnSample(sample microburst.Sample) {
+	if s.rxHist != nil && s.trackRx {
+		s.rxHist.record(sample.RxBytes)
 	}
-
-	if txData != nil {
-		txData.Value = statData{t, txbytes}
-		txData = txData.Next()
+	if s.txHist != nil && s.trackTx {
+		s.txHist.record(sample.TxBytes)
+	}
+	for i, h := range s.classHists {
+		h.record(sample.Classes[i])
 	}
-}
 
-type statData struct {
-	t time.Time
-	v uint64
-}
+	if s.packetSizes {
+		if s.trackRx {
+			s.rxSizes.add(sample.RxBytes, sample.RxSizes)
+		}
+		if s.trackTx {
+			s.txSizes.add(sample.TxBytes, sample.TxSizes)
+		}
+	}
 
-func saveGraph() {
-	page := components.NewPage()
-	page.SetLayout(components.PageFlexLayout)
-	page.AddCharts(
-		getRxScatter(),
-		getTxScatter(),
-	)
-	f, err := os.Create(saveGraphHtmlPath)
-	if err != nil {
-		panic(err)
+	if s.incast {
+		s.incasts.add(incastWindowOf(sample))
 	}
-	page.Render(io.MultiWriter(f))
-	log.Printf("saved graph at %s\n", saveGraphHtmlPath)
 }
 
-func getRxScatter() *charts.Scatter {
-	scatter := newScatter("Data receive")
+// OnAnnotation records the annotation, the histograms keep running across
+// it
+func (s *summary) OnAnnotation(a microburst.Annotation) {
+	s.annotations = append(s.annotations, a)
+}
 
-	var x []string
-	var d []opts.ScatterData
-	rxData.Do(func(p any) {
-		if p == nil {
-			return
+// Close prints the summary
+func (s *summary) Close() error {
+	fmt.Fprintln(s.w)
+
+	if s.rxHist != nil {
+		fmt.Fprintf(s.w, "Received (%s bytes):\n", s.accounting)
+		fmt.Fprintf(s.w, "Mean: %v   StdDev: %v   Min: %v   Max: %v\n", humanize.Bytes(uint64(s.rxHist.Mean())), humanize.Bytes(uint64(s.rxHist.StdDev())), humanize.Bytes(uint64(s.rxHist.Min())), humanize.Bytes(uint64(s.rxHist.Max())))
+		fmt.Fprintf(s.w, "Histogram:\n")
+		fmt.Fprintln(s.w, getHistogram(s.rxHist.Histogram, func(v float64) string { return humanize.Bytes(uint64(v)) }))
+
+		fmt.Fprintf(s.w, "Transferred (%s bytes):\n", s.accounting)
+		fmt.Fprintf(s.w, "Mean: %v   StdDev: %v   Min: %v   Max: %v\n", humanize.Bytes(uint64(s.txHist.Mean())), humanize.Bytes(uint64(s.txHist.StdDev())), humanize.Bytes(uint64(s.txHist.Min())), humanize.Bytes(uint64(s.txHist.Max())))
+		fmt.Fprintf(s.w, "Histogram:\n")
+		fmt.Fprintln(s.w, getHistogram(s.txHist.Histogram, func(v float64) string { return humanize.Bytes(uint64(v)) }))
+
+		for i, class := range s.classes {
+			h := s.classHists[i]
+			fmt.Fprintf(s.w, "%s (%s bytes):\n", class.Title, s.accounting)
+			fmt.Fprintf(s.w, "Mean: %v   StdDev: %v   Min: %v   Max: %v\n", humanize.Bytes(uint64(h.Mean())), humanize.Bytes(uint64(h.StdDev())), humanize.Bytes(uint64(h.Min())), humanize.Bytes(uint64(h.Max())))
+			fmt.Fprintf(s.w, "Histogram:\n")
+			fmt.Fprintln(s.w, getHistogram(h.Histogram, func(v float64) string { return humanize.Bytes(uint64(v)) }))
 		}
-		rxd := p.(statData)
-		x = append(x, rxd.t.Format("15:04:05.000"))
-		d = append(d, opts.ScatterData{
-			Value:        rxd.v,
-			Symbol:       "roundRect",
-			SymbolSize:   5,
-			SymbolRotate: 0,
-		})
-	})
-
-	scatter.SetXAxis(x).
-		AddSeries("Receive", d)
-
-	return scatter
-}
 
-func getTxScatter() *charts.Scatter {
-	scatter := newScatter("Data transfer")
+		if len(s.annotations) > 0 {
+			fmt.Fprintf(s.w, "Annotations:\n")
+			for _, a := range s.annotations {
+				fmt.Fprintf(s.w, "%s %s\n", a.Time.Format("15:04:05.000"), a.Text)
+			}
+			fmt.Fprintln(s.w)
+		}
+	}
 
-	var x []string
-	var d []opts.ScatterData
-	txData.Do(func(p any) {
-		if p == nil {
-			return
+	if s.packetSizes {
+		if s.trackRx {
+			s.rxSizes.print(s.w, "Received")
 		}
-		txd := p.(statData)
-		x = append(x, txd.t.Format("15:04:05.000"))
-		d = append(d, opts.ScatterData{
-			Value:        txd.v,
-			Symbol:       "roundRect",
-			SymbolSize:   5,
-			SymbolRotate: 0,
-		})
-	})
-
-	scatter.SetXAxis(x).
-		AddSeries("Transfer", d)
-
-	return scatter
-}
+		if s.trackTx {
+			s.txSizes.print(s.w, "Transmitted")
+		}
+	}
+
+	if s.incast {
+		s.incasts.print(s.w)
+	}
 
-func newScatter(title string) *charts.Scatter {
-	scatter := charts.NewScatter()
-	scatter.SetGlobalOptions(
-		charts.WithTitleOpts(opts.Title{Title: title}),
-		charts.WithLegendOpts(opts.Legend{Type: "scroll"}),
-		charts.WithXAxisOpts(opts.XAxis{Name: "Time", Show: true}),
-		charts.WithYAxisOpts(opts.YAxis{Name: "Bytes (KB)", Show: true}),
-		charts.WithDataZoomOpts(opts.DataZoom{
-			Type:  "slider",
-			Start: 0,
-			End:   10,
-		}),
-		charts.WithInitializationOpts(opts.Initialization{PageTitle: "Network microburst charts"}),
-		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item", TriggerOn: "mousemove|click", Enterable: true}),
-		charts.WithToolboxOpts(opts.Toolbox{Show: true, Feature: &opts.ToolBoxFeature{
-			DataZoom: &opts.ToolBoxFeatureDataZoom{
-				Show: true,
-				Title: map[string]string{
-					"zoom": "zoom",
-					"back": "back",
-				}}}}),
-	)
-	return scatter
+	return nil
 }
 
 type Bucket struct {
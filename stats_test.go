@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surki/network-microburst/pkg/microburst"
+)
+
+func TestSummary(t *testing.T) {
+	printHistogram = true
+	defer func() { printHistogram = false }()
+
+	var b bytes.Buffer
+	s := newSummary(&b, []microburst.Class{{Name: "local", Title: "Received for local delivery"}})
+	runSynthetic(t, `
+classes local
+1000 2000 500 x9
+100000 2000 500
+@ filters changed
+`, s)
+	require.NoError(t, s.Close())
+
+	require.Equal(t, int64(10), s.rxHist.TotalCount())
+	require.InDelta(t, 100000, s.rxHist.Max(), 100)
+	require.Equal(t, int64(2000), s.txHist.Min())
+	require.Contains(t, b.String(), "Received (skb bytes):\nMean: 11 kB")
+	require.Contains(t, b.String(), "Received for local delivery (skb bytes):\nMean: 500 B")
+	require.Contains(t, b.String(), "Annotations:\n10:00:00.010 filters changed\n")
+}
@@ -0,0 +1,53 @@
+#!/bin/bash
+#
+# Checks the inner flow accounting (--decap) with a VXLAN tunnel between two
+# network namespaces, connected by a veth pair:
+#
+#   mb-a: mbv-a 192.0.2.1   --veth--   mb-b: mbv-b 192.0.2.2
+#         vx-a  198.51.100.1  --vxlan 42-- vx-b  198.51.100.2
+#
+# Needs root, iproute2 and a built network-microburst.
+
+set -euo pipefail
+
+BIN=${BIN:-$(dirname "$0")/../network-microburst}
+OUT=$(mktemp)
+
+cleanup() {
+	ip netns del mb-a 2>/dev/null || true
+	ip netns del mb-b 2>/dev/null || true
+	rm -f "$OUT"
+}
+trap cleanup EXIT
+
+ip netns add mb-a
+ip netns add mb-b
+ip link add mbv-a netns mb-a type veth peer name mbv-b netns mb-b
+
+for ns in a b; do
+	n=$([ $ns = a ] && echo 1 || echo 2)
+	r=$([ $ns = a ] && echo 2 || echo 1)
+	ip -n mb-$ns addr add 192.0.2.$n/24 dev mbv-$ns
+	ip -n mb-$ns link set mbv-$ns up
+	ip -n mb-$ns link add vx-$ns type vxlan id 42 remote 192.0.2.$r dstport 4789 dev mbv-$ns
+	ip -n mb-$ns addr add 198.51.100.$n/24 dev vx-$ns
+	ip -n mb-$ns link set vx-$ns up
+done
+
+# Only the inner icmp packets of VNI 42, on the underlay interface
+"$BIN" --show-graph=false --burst-window 100ms --filter-interface mbv-a \
+	--decap --vni-groups 42 'encap vxlan and icmp' >"$OUT" &
+pid=$!
+sleep 3
+
+ip netns exec mb-a ping -c 5 -i 0.2 -s 1000 -q 198.51.100.2 >/dev/null
+
+kill -INT $pid
+wait $pid || true
+
+cat "$OUT"
+if ! grep -q 'rx:vni=42: [0-9]' "$OUT" || ! grep -q 'tx:vni=42: [0-9]' "$OUT"; then
+	echo "FAIL: no VNI 42 bytes"
+	exit 1
+fi
+echo "PASS"